@@ -10,6 +10,19 @@ import (
 type ACLRule struct {
 	Subjects []string `json:"subjects,omitempty"`
 	Allow    bool     `json:"allow,omitempty"`
+
+	// Where each subject was defined (e.g. file:line), in the same order as Subjects.
+	// Only used to explain decisions in logs and errors.
+	Sources []string `json:"sources,omitempty"`
+}
+
+// isHostnameRule reports whether the rule can be decided with the hostname only.
+func isHostnameRule(rule aclRule) bool {
+	switch rule.(type) {
+	case *aclDomainRule, *aclCategoryRule:
+		return true
+	}
+	return false
 }
 
 type aclDecision uint8
@@ -22,11 +35,30 @@ const (
 
 type aclRule interface {
 	tryMatch(ip net.IP, domain string) aclDecision
+	String() string
+}
+
+// aclRuleInfo holds what every rule knows about itself, so that a decision can be traced back to its origin.
+type aclRuleInfo struct {
+	subject string
+	source  string
+	allow   bool
+}
+
+func (a *aclRuleInfo) String() string {
+	action := "deny"
+	if a.allow {
+		action = "allow"
+	}
+	if len(a.source) == 0 {
+		return action + " " + a.subject
+	}
+	return action + " " + a.subject + " (" + a.source + ")"
 }
 
 type aclIPRule struct {
-	net   net.IPNet
-	allow bool
+	aclRuleInfo
+	net net.IPNet
 }
 
 func (a *aclIPRule) tryMatch(ip net.IP, domain string) aclDecision {
@@ -40,9 +72,9 @@ func (a *aclIPRule) tryMatch(ip net.IP, domain string) aclDecision {
 }
 
 type aclDomainRule struct {
+	aclRuleInfo
 	domain            string
 	subdomainsAllowed bool
-	allow             bool
 }
 
 func (a *aclDomainRule) tryMatch(ip net.IP, domain string) aclDecision {
@@ -58,8 +90,46 @@ func (a *aclDomainRule) tryMatch(ip net.IP, domain string) aclDecision {
 	return aclDecisionNoMatch
 }
 
+type aclCategoryRule struct {
+	aclRuleInfo
+	category string
+	db       *categoryDB
+}
+
+func (a *aclCategoryRule) tryMatch(ip net.IP, domain string) aclDecision {
+	if len(domain) == 0 || !a.db.hasCategory(domain, a.category) {
+		return aclDecisionNoMatch
+	}
+	if a.allow {
+		return aclDecisionAllow
+	}
+	return aclDecisionDeny
+}
+
+// aclGeoIPRule matches IP addresses by country (if country is set) or autonomous system number.
+type aclGeoIPRule struct {
+	aclRuleInfo
+	country string
+	asn     uint
+	db      *geoIPDB
+}
+
+func (a *aclGeoIPRule) tryMatch(ip net.IP, domain string) aclDecision {
+	if ip == nil {
+		return aclDecisionNoMatch
+	}
+	record := a.db.lookup(ip)
+	if len(a.country) > 0 && record.Country.ISOCode != a.country || len(a.country) == 0 && record.ASN != a.asn {
+		return aclDecisionNoMatch
+	}
+	if a.allow {
+		return aclDecisionAllow
+	}
+	return aclDecisionDeny
+}
+
 type aclAllRule struct {
-	allow bool
+	aclRuleInfo
 }
 
 func (a *aclAllRule) tryMatch(ip net.IP, domain string) aclDecision {
@@ -69,9 +139,44 @@ func (a *aclAllRule) tryMatch(ip net.IP, domain string) aclDecision {
 	return aclDecisionDeny
 }
 
-func newACLRule(ruleSubject string, allow bool) (aclRule, error) {
+// aclDatabases holds the databases that some rule subjects are looked up in.
+type aclDatabases struct {
+	categories *categoryDB
+	geoIP      *geoIPDB
+}
+
+func newACLRule(ruleSubject, source string, allow bool, dbs aclDatabases) (aclRule, error) {
+	info := aclRuleInfo{subject: ruleSubject, source: source, allow: allow}
 	if ruleSubject == "all" {
-		return &aclAllRule{allow: allow}, nil
+		return &aclAllRule{aclRuleInfo: info}, nil
+	}
+	if category, ok := strings.CutPrefix(ruleSubject, "category:"); ok {
+		if dbs.categories == nil {
+			return nil, errors.New(ruleSubject + ": category rules require a category database")
+		}
+		if len(category) == 0 {
+			return nil, errors.New(ruleSubject + ": empty category")
+		}
+		return &aclCategoryRule{aclRuleInfo: info, category: strings.ToLower(category), db: dbs.categories}, nil
+	}
+	if country, ok := strings.CutPrefix(ruleSubject, "country:"); ok {
+		if dbs.geoIP == nil {
+			return nil, errors.New(ruleSubject + ": country rules require a GeoIP database")
+		}
+		if len(country) != 2 {
+			return nil, errors.New(ruleSubject + ": expected a two-letter country code")
+		}
+		return &aclGeoIPRule{aclRuleInfo: info, country: strings.ToUpper(country), db: dbs.geoIP}, nil
+	}
+	if asn, ok := strings.CutPrefix(ruleSubject, "asn:"); ok {
+		if dbs.geoIP == nil {
+			return nil, errors.New(ruleSubject + ": asn rules require a GeoIP database")
+		}
+		number, err := parseASN(asn)
+		if err != nil {
+			return nil, errors.New(ruleSubject + ": " + err.Error())
+		}
+		return &aclGeoIPRule{aclRuleInfo: info, asn: number, db: dbs.geoIP}, nil
 	}
 	_, ipNet, err := net.ParseCIDR(ruleSubject)
 	if err != nil {
@@ -84,7 +189,7 @@ func newACLRule(ruleSubject string, allow bool) (aclRule, error) {
 		}
 	}
 	if err == nil {
-		return &aclIPRule{net: *ipNet, allow: allow}, nil
+		return &aclIPRule{aclRuleInfo: info, net: *ipNet}, nil
 	}
 
 	subdomainsAllowed := false
@@ -96,7 +201,20 @@ func newACLRule(ruleSubject string, allow bool) (aclRule, error) {
 	if err != nil {
 		return nil, errors.New(ruleSubject + " could not be parsed as either IP, IP network, or domain: " + err.Error())
 	}
-	return &aclDomainRule{domain: ruleSubject, subdomainsAllowed: subdomainsAllowed, allow: allow}, nil
+	return &aclDomainRule{aclRuleInfo: info, domain: ruleSubject, subdomainsAllowed: subdomainsAllowed}, nil
+}
+
+// aclDeniedError is returned when a destination is rejected by the ACL. rule may be nil if no rule matched.
+type aclDeniedError struct {
+	msg  string
+	rule aclRule
+}
+
+func (e *aclDeniedError) Error() string {
+	if e.rule == nil {
+		return e.msg
+	}
+	return e.msg + " by rule: " + e.rule.String()
 }
 
 // isValidDomainLite shamelessly rejects non-LDH names. returns nil if domains seems valid
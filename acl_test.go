@@ -1,8 +1,16 @@
 package forwardproxy
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
 )
 
 /*
@@ -196,3 +204,105 @@ func TestBlacklistAllowing(t *testing.T) {
 		}
 	}
 }
+
+func TestACLDecisionExplained(t *testing.T) {
+	h := Handler{ACL: []ACLRule{
+		{Subjects: []string{"*.example.com", "8.8.8.8"}, Sources: []string{"deny.txt:3", "deny.txt:4"}},
+	}}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, rule := h.hostIsAllowed("www.example.com", net.ParseIP("1.1.1.1"))
+	if allowed || rule == nil || rule.String() != "deny *.example.com (deny.txt:3)" {
+		t.Fatalf("Expected denial by the domain rule, got: %v %v", allowed, rule)
+	}
+	allowed, rule = h.hostIsAllowed("dns.google", net.ParseIP("8.8.8.8"))
+	if allowed || rule == nil || rule.String() != "deny 8.8.8.8 (deny.txt:4)" {
+		t.Fatalf("Expected denial by the IP rule, got: %v %v", allowed, rule)
+	}
+	allowed, rule = h.hostIsAllowed("localhost", net.ParseIP("127.0.0.1"))
+	if allowed || rule == nil || rule.String() != "deny 127.0.0.0/8 (default policy)" {
+		t.Fatalf("Expected denial by the default policy, got: %v %v", allowed, rule)
+	}
+	allowed, rule = h.hostIsAllowed("caddyserver.com", net.ParseIP("1.1.1.1"))
+	if !allowed || rule == nil || rule.String() != "allow all (default policy)" {
+		t.Fatalf("Expected the catch-all rule to allow, got: %v %v", allowed, rule)
+	}
+
+	_, err := h.dialContextCheckACL(context.Background(), "tcp", "www.example.com:443", nil)
+	var aclErr *aclDeniedError
+	if !errors.As(err, &aclErr) || aclErr.Error() != "disallowed host www.example.com by rule: deny *.example.com (deny.txt:3)" {
+		t.Fatalf("Expected the error to explain the denial, got: %v", err)
+	}
+}
+
+func TestUpstreamACL(t *testing.T) {
+	h := Handler{ACL: []ACLRule{{Subjects: []string{"*.example.com"}}}}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.checkUpstreamACL(context.Background(), "www.example.com"); err == nil {
+		t.Fatal("Expected hostname rules to be enforced for upstream destinations")
+	}
+	if err := h.checkUpstreamACL(context.Background(), "localhost"); err != nil {
+		t.Fatal("Expected IP rules to be skipped for hostnames in hostname mode, got:", err)
+	}
+	for _, host := range []string{"127.0.0.1", "10.0.0.1", "::1"} {
+		if err := h.checkUpstreamACL(context.Background(), host); err == nil {
+			t.Fatalf("Expected IP rules to be enforced on IP address %s in hostname mode", host)
+		}
+	}
+	if err := h.checkUpstreamACL(context.Background(), "203.0.113.1"); err != nil {
+		t.Fatal("Expected allowed IP addresses to pass in hostname mode, got:", err)
+	}
+
+	h.UpstreamACL = upstreamACLResolve
+	if err := h.checkUpstreamACL(context.Background(), "127.0.0.1"); err == nil {
+		t.Fatal("Expected IP rules to be enforced in resolve mode")
+	}
+}
+
+func TestCategoryRules(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "categories.txt")
+	if err := os.WriteFile(dbPath, []byte("# comment\ncasino.example,Gambling\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := Handler{
+		ACL:                    []ACLRule{{Subjects: []string{"category:gambling", "category:malware"}}},
+		CategoryDatabases:      []string{dbPath},
+		DatabaseReloadInterval: caddy.Duration(10 * time.Millisecond),
+	}
+	if err := h.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("1.1.1.1")
+	if allowed, _ := h.hostIsAllowed("www.casino.example", ip); allowed {
+		t.Fatal("Expected subdomains of a categorized domain to be denied")
+	}
+	if allowed, _ := h.hostIsAllowed("casino.example.org", ip); !allowed {
+		t.Fatal("Expected uncategorized domain to be allowed")
+	}
+
+	if err := os.WriteFile(dbPath, []byte("casino.example,gambling\nbad.example,malware\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if allowed, _ := h.hostIsAllowed("bad.example", ip); !allowed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected modified category database to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := (&Handler{ACL: []ACLRule{{Subjects: []string{"category:malware"}}}}).Provision(caddy.Context{Context: ctx}); err == nil {
+		t.Fatal("Expected category rules without a category database to be rejected")
+	}
+
+}
@@ -0,0 +1,286 @@
+package forwardproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// AuthUser is a proxy user whose password is only stored as a hash.
+type AuthUser struct {
+	Username string `json:"username,omitempty"`
+
+	// Password hash, in one of the following formats:
+	//   - bcrypt: $2a$, $2b$ or $2y$ (e.g. from `caddy hash-password`)
+	//   - argon2: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+	//   - scrypt: $scrypt$ln=17,r=8,p=1$<salt>$<hash>
+	//   - apr1 and {SHA}, as written by Apache's htpasswd (discouraged: these are weak)
+	// with salt and hash of argon2 and scrypt in base64.
+	Password string `json:"password,omitempty"`
+}
+
+// passwordHashes looks up password hashes by username, from the configuration and from htpasswd files.
+// The table is replaced while in use when files are reloaded.
+type passwordHashes struct {
+	static []AuthUser
+	files  []string
+	users  atomic.Pointer[passwordTable]
+	cache  *verifiedCredentialCache // nil if disabled
+}
+
+// passwordTable is a snapshot of the users, with the hash that unknown users are checked against.
+type passwordTable struct {
+	users map[string]passwordHash
+	dummy passwordHash // the most expensive hash to verify, nil if there are no users
+}
+
+func newPasswordHashes(users []AuthUser, files []string, cacheSize int) (*passwordHashes, error) {
+	p := &passwordHashes{static: users, files: files}
+	if cacheSize > 0 {
+		p.cache = &verifiedCredentialCache{size: cacheSize, entries: make(map[[sha256.Size]byte]struct{})}
+	}
+	return p, p.reload()
+}
+
+// reload rebuilds the table from the configured users and the current contents of the files,
+// or leaves it as is if they cannot be loaded.
+func (p *passwordHashes) reload() error {
+	users := p.static
+	for _, file := range p.files {
+		fileUsers, err := loadHtpasswdFile(file)
+		if err != nil {
+			return err
+		}
+		users = append(users[:len(users):len(users)], fileUsers...)
+	}
+	table := passwordTable{users: make(map[string]passwordHash, len(users))}
+	for _, user := range users {
+		if len(user.Username) == 0 || strings.Contains(user.Username, ":") {
+			return fmt.Errorf("invalid username: %q", user.Username)
+		}
+		if _, ok := table.users[user.Username]; ok {
+			return fmt.Errorf("user %s is defined more than once", user.Username)
+		}
+		hash, err := parsePasswordHash(user.Password)
+		if err != nil {
+			return fmt.Errorf("user %s: %v", user.Username, err)
+		}
+		table.users[user.Username] = hash
+		if table.dummy == nil || hash.cost() > table.dummy.cost() {
+			table.dummy = hash
+		}
+	}
+	p.users.Store(&table)
+	return nil
+}
+
+// verify checks the password of username. Unknown users take about as long to check as known ones.
+func (p *passwordHashes) verify(username, password string) bool {
+	table := p.users.Load()
+	hash, known := table.users[username]
+	if !known {
+		// compare against the slowest hash anyway, so that timing doesn't reveal which users exist
+		if hash = table.dummy; hash == nil {
+			return false
+		}
+	}
+	key := sha256.Sum256([]byte(hash.String() + "\x00" + password))
+	if known && p.cache != nil && p.cache.contains(key) {
+		return true
+	}
+	ok := hash.verify(password) && known
+	if ok && p.cache != nil {
+		p.cache.add(key)
+	}
+	return ok
+}
+
+// usernames returns the users in the table.
+func (p *passwordHashes) usernames() []string {
+	table := p.users.Load()
+	users := make([]string, 0, len(table.users))
+	for user := range table.users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// verifiedCredentialCache remembers hash and password pairs that were verified, to avoid hashing them again.
+// Only successful verifications are cached, so that guessing passwords stays expensive.
+type verifiedCredentialCache struct {
+	mu      sync.RWMutex
+	size    int
+	entries map[[sha256.Size]byte]struct{}
+}
+
+func (c *verifiedCredentialCache) contains(key [sha256.Size]byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *verifiedCredentialCache) add(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for evicted := range c.entries { // evict a random entry
+			delete(c.entries, evicted)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
+
+// passwordHash is a parsed password hash.
+type passwordHash interface {
+	verify(password string) bool
+	String() string // the hash as configured
+	cost() float64  // rough work of verify, comparable across formats
+}
+
+// parsePasswordHash parses a hash in one of the formats documented on AuthUser.
+func parsePasswordHash(hash string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(hash), nil
+	case strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$argon2i$"):
+		return parseArgon2Hash(hash)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return parseScryptHash(hash)
+	case strings.HasPrefix(hash, "$apr1$"):
+		return parseAPR1Hash(hash)
+	case strings.HasPrefix(hash, "{SHA}"):
+		return parseSHA1Hash(hash)
+	}
+	return nil, errors.New("unsupported password hash format")
+}
+
+type bcryptHash string
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(h), []byte(password)) == nil
+}
+
+func (h bcryptHash) String() string {
+	return string(h)
+}
+
+func (h bcryptHash) cost() float64 {
+	cost, _ := bcrypt.Cost([]byte(h))
+	return 64 * math.Exp2(float64(cost))
+}
+
+type argon2Hash struct {
+	hash          string
+	id            bool
+	memory, time  uint32
+	threads       uint8
+	salt, derived []byte
+}
+
+// parseArgon2Hash parses a hash in the PHC string format used by the reference implementation.
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	h := &argon2Hash{hash: hash, id: fields[1] == "argon2id"}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2 parameters: %v", err)
+	}
+	if h.time < 1 || h.threads < 1 || h.memory < 8*uint32(h.threads) {
+		return nil, errors.New("argon2 parameters are out of range")
+	}
+	var err error
+	if h.salt, h.derived, err = decodeSaltAndKey(fields[4], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(password string) bool {
+	var derived []byte
+	if h.id {
+		derived = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.derived)))
+	} else {
+		derived = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.derived)))
+	}
+	return subtle.ConstantTimeCompare(derived, h.derived) == 1
+}
+
+func (h *argon2Hash) String() string {
+	return h.hash
+}
+
+func (h *argon2Hash) cost() float64 {
+	return float64(h.memory) * float64(h.time)
+}
+
+type scryptHash struct {
+	hash          string
+	logN, r, p    int
+	salt, derived []byte
+}
+
+// parseScryptHash parses a hash in the format $scrypt$ln=<log2(N)>,r=<r>,p=<p>$<salt>$<hash>.
+func parseScryptHash(hash string) (*scryptHash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 {
+		return nil, errors.New("malformed scrypt hash")
+	}
+	h := &scryptHash{hash: hash}
+	if _, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &h.logN, &h.r, &h.p); err != nil {
+		return nil, fmt.Errorf("malformed scrypt parameters: %v", err)
+	}
+	if h.logN <= 0 || h.logN >= 32 || h.r <= 0 || h.p <= 0 {
+		return nil, errors.New("scrypt parameters are out of range")
+	}
+	var err error
+	if h.salt, h.derived, err = decodeSaltAndKey(fields[3], fields[4]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *scryptHash) verify(password string) bool {
+	derived, err := scrypt.Key([]byte(password), h.salt, 1<<h.logN, h.r, h.p, len(h.derived))
+	return err == nil && subtle.ConstantTimeCompare(derived, h.derived) == 1
+}
+
+func (h *scryptHash) String() string {
+	return h.hash
+}
+
+func (h *scryptHash) cost() float64 {
+	return math.Exp2(float64(h.logN)) * float64(h.r) * float64(h.p) / 4
+}
+
+func decodeSaltAndKey(salt, key string) ([]byte, []byte, error) {
+	decodedSalt, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(salt, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed salt: %v", err)
+	}
+	decodedKey, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed hash: %v", err)
+	}
+	if len(decodedKey) == 0 {
+		return nil, nil, errors.New("empty hash")
+	}
+	return decodedSalt, decodedKey, nil
+}
@@ -0,0 +1,726 @@
+package forwardproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// newAuthRequest returns a request with Proxy-Authorization set to authorization and a replacer in its context.
+func newAuthRequest(authorization string) (*http.Request, *caddy.Replacer) {
+	r, _ := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	if len(authorization) > 0 {
+		r.Header.Set("Proxy-Authorization", authorization)
+	}
+	repl := caddy.NewReplacer()
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)), repl
+}
+
+func TestPasswordHashes(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	b64 := base64.RawStdEncoding.EncodeToString
+	argon2ed := "$argon2id$v=19$m=1024,t=1,p=1$" + b64(salt) + "$" +
+		b64(argon2.IDKey([]byte("argon2-pass"), salt, 1, 1024, 1, 32))
+	scrypted, err := scrypt.Key([]byte("scrypt-pass"), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler{
+		AuthUsers: []AuthUser{
+			{Username: "bcrypt", Password: string(bcrypted)},
+			{Username: "argon2", Password: argon2ed},
+			{Username: "scrypt", Password: "$scrypt$ln=10,r=8,p=1$" + b64(salt) + "$" + b64(scrypted)},
+		},
+		AuthCacheSize: 1,
+	}
+	if err = h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"bcrypt", "argon2", "scrypt"} {
+		for i := 0; i < 2; i++ { // second time around, the cache may be used
+			r, repl := newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+user+"-pass")))
+			if err = h.checkCredentials(r); err != nil {
+				t.Fatalf("Expected %s to be authenticated, got: %v", user, err)
+			}
+			if id, _ := repl.GetString("http.auth.user.id"); id != user {
+				t.Fatalf("Expected user id %s, got: %s", user, id)
+			}
+		}
+		r, repl := newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":wrong")))
+		if err = h.checkCredentials(r); err == nil {
+			t.Fatalf("Expected wrong password of %s to be rejected", user)
+		}
+		if id, _ := repl.GetString("http.auth.user.id"); id != "invalid:"+user {
+			t.Fatalf("Expected user id invalid:%s, got: %s", user, id)
+		}
+	}
+	r, _ := newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte("nobody:bcrypt-pass")))
+	if err = h.checkCredentials(r); err == nil {
+		t.Fatal("Expected unknown user to be rejected")
+	}
+
+	h = Handler{AuthUsers: []AuthUser{{Username: "user", Password: "plaintext"}}}
+	if err = h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatal("Expected plaintext password to be rejected as a hash")
+	}
+	derived := b64(argon2.IDKey([]byte("argon2-pass"), salt, 1, 1024, 1, 32))
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=7,t=1,p=1", "m=15,t=1,p=2"} {
+		if _, err = parsePasswordHash("$argon2id$v=19$" + params + "$" + b64(salt) + "$" + derived); err == nil {
+			t.Fatal("Expected argon2 parameters to be rejected:", params)
+		}
+	}
+}
+
+func TestAuthenticationProviders(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("provider-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		authentication http_basic bcrypt {
+			provider-user ` + base64.StdEncoding.EncodeToString(hash) + `
+		}
+	}`)
+	if err = h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err = h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !h.authEnabled() {
+		t.Fatal("Expected authentication providers to enable authentication")
+	}
+
+	r, repl := newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte("provider-user:provider-pass")))
+	if err = h.checkCredentials(r); err != nil {
+		t.Fatal("Expected provider to authenticate the user, got:", err)
+	}
+	if id, _ := repl.GetString("http.auth.user.id"); id != "provider-user" {
+		t.Fatal("Expected user id provider-user, got:", id)
+	}
+	if r.Header.Get("Authorization") != "" {
+		t.Fatal("Expected the original request to be left untouched")
+	}
+	r, _ = newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte("provider-user:wrong")))
+	if err = h.checkCredentials(r); err == nil {
+		t.Fatal("Expected wrong password to be rejected")
+	}
+	r, _ = newAuthRequest("")
+	r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("provider-user:provider-pass")))
+	if err = h.checkCredentials(r); err == nil {
+		t.Fatal("Expected credentials in Authorization to be ignored")
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err = os.WriteFile(path, []byte("# users\n"+
+		"apr1:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"+ // openssl passwd -apr1 -salt saltsalt password
+		"sha1:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+ // password
+		"bcrypt:"+string(bcrypted)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := Handler{AuthFiles: []string{path}, DatabaseReloadInterval: caddy.Duration(10 * time.Millisecond)}
+	if err = h.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(user, pass string) error {
+		r, _ := newAuthRequest("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		return h.checkCredentials(r)
+	}
+	for user, pass := range map[string]string{"apr1": "password", "sha1": "password", "bcrypt": "bcrypt-pass"} {
+		if err = check(user, pass); err != nil {
+			t.Fatalf("Expected %s to be authenticated, got: %v", user, err)
+		}
+		if err = check(user, pass+"!"); err == nil {
+			t.Fatalf("Expected wrong password of %s to be rejected", user)
+		}
+	}
+
+	if err = os.WriteFile(path, []byte("sha1:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); check("apr1", "password") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected user removed from modified htpasswd file to be rejected")
+		}
+	}
+	if err = check("sha1", "password"); err != nil {
+		t.Fatal("Expected remaining user to be authenticated, got:", err)
+	}
+}
+
+func TestPasswordHashesDummy(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []AuthUser{
+		{Username: "sha1", Password: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+		{Username: "apr1", Password: "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+	}
+	for _, test := range []struct {
+		users []AuthUser
+		dummy string
+	}{
+		{users[:1], "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+		{users, "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{append([]AuthUser{users[1]}, users[0]), "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{append(users, AuthUser{Username: "bcrypt", Password: string(bcrypted)}), string(bcrypted)},
+	} {
+		p, err := newPasswordHashes(test.users, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dummy := p.users.Load().dummy.String(); dummy != test.dummy {
+			t.Fatalf("Expected dummy hash %s, got: %s", test.dummy, dummy)
+		}
+		if p.verify("nobody", "password") {
+			t.Fatal("Expected unknown user to be rejected")
+		}
+	}
+}
+
+// signJWT builds a token with the given claims, signed with key (a []byte HS256 secret, or an ES256 or EdDSA private key).
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestBearerAuth(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writePublicKey := func(name string, key any) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ecFile := writePublicKey("ec.pem", &ecKey.PublicKey)
+	edFile := writePublicKey("ed.pem", edPublic)
+
+	now := time.Now().Unix()
+	valid := map[string]any{"sub": "alice", "aud": []string{"other", "proxy"}, "exp": now + 60}
+	for _, tc := range []struct {
+		config string
+		alg    string
+		key    any
+	}{
+		{"bearer_auth HS256 {\n secret s3cr3t\n audience proxy\n }", jwtHS256, []byte("s3cr3t")},
+		{"bearer_auth ES256 {\n key_file " + ecFile + "\n audience proxy\n }", jwtES256, ecKey},
+		{"bearer_auth EdDSA {\n key_file " + edFile + "\n audience proxy\n }", jwtEdDSA, edKey},
+	} {
+		var h Handler
+		if err = h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\n" + tc.config + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err = h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+			t.Fatal(err)
+		}
+		if !h.authEnabled() {
+			t.Fatal("Expected bearer_auth to enable authentication")
+		}
+		r, repl := newAuthRequest("Bearer " + signJWT(t, tc.alg, tc.key, valid))
+		if err = h.checkCredentials(r); err != nil {
+			t.Fatalf("Expected %s token to be accepted, got: %v", tc.alg, err)
+		}
+		if id, _ := repl.GetString("http.auth.user.id"); id != "alice" {
+			t.Fatalf("Expected user id alice, got: %s", id)
+		}
+
+		for name, token := range map[string]string{
+			"expired":         signJWT(t, tc.alg, tc.key, map[string]any{"sub": "alice", "aud": "proxy", "exp": now - 60}),
+			"without expiry":  signJWT(t, tc.alg, tc.key, map[string]any{"sub": "alice", "aud": "proxy"}),
+			"not yet valid":   signJWT(t, tc.alg, tc.key, map[string]any{"sub": "alice", "aud": "proxy", "exp": now + 60, "nbf": now + 30}),
+			"wrong audience":  signJWT(t, tc.alg, tc.key, map[string]any{"sub": "alice", "aud": "other", "exp": now + 60}),
+			"without subject": signJWT(t, tc.alg, tc.key, map[string]any{"aud": "proxy", "exp": now + 60}),
+			"wrong key":       signJWT(t, jwtHS256, []byte("wrong"), valid),
+			"unsigned":        strings.TrimSuffix(signJWT(t, "none", nil, valid), "."),
+		} {
+			r, repl = newAuthRequest("Bearer " + token)
+			if err = h.checkCredentials(r); err == nil {
+				t.Fatalf("Expected %s %s token to be rejected", name, tc.alg)
+			}
+			if id, _ := repl.GetString("http.auth.user.id"); !strings.HasPrefix(id, "invalidtoken:") {
+				t.Fatalf("Expected user id to report the invalid token, got: %s", id)
+			}
+		}
+	}
+
+	h := Handler{BearerAuth: &BearerAuth{Algorithm: jwtES256, KeyFile: edFile}}
+	if err = h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatal("Expected an Ed25519 key to be rejected for ES256")
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/laptop/alice")
+	website, _ := url.Parse("https://alice.example.org")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice-cn"},
+		DNSNames:       []string{"alice.example.org"},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{website, spiffeID},
+	}
+	for field, expected := range map[string]string{
+		"":       "alice-cn",
+		"dns":    "alice.example.org",
+		"email":  "alice@example.org",
+		"uri":    "https://alice.example.org",
+		"spiffe": "spiffe://example.org/laptop/alice",
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\nclient_cert_auth " + field + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+			t.Fatal(err)
+		}
+		if !h.authEnabled() {
+			t.Fatal("Expected client_cert_auth to enable authentication")
+		}
+		r, repl := newAuthRequest("")
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if err := h.checkCredentials(r); err == nil {
+			t.Fatal("Expected a certificate that was not verified to be rejected")
+		}
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		if err := h.checkCredentials(r); err != nil {
+			t.Fatalf("Expected verified certificate to authenticate the client, got: %v", err)
+		}
+		if id, _ := repl.GetString("http.auth.user.id"); id != expected {
+			t.Fatalf("Expected user id %s for username field %q, got: %s", expected, field, id)
+		}
+	}
+
+	h := Handler{ClientCertAuth: &ClientCertAuth{Username: "spiffe"}, AuthCredentials: [][]byte{EncodeAuthCredentials("bob", "pass")}}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	r, repl := newAuthRequest("Basic " + string(EncodeAuthCredentials("bob", "pass")))
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "no-spiffe"}}}}}
+	if err := h.checkCredentials(r); err != nil {
+		t.Fatalf("Expected basic credentials to be accepted without a usable certificate, got: %v", err)
+	}
+	if id, _ := repl.GetString("http.auth.user.id"); id != "bob" {
+		t.Fatal("Expected user id bob, got:", id)
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	var calls int
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-Forwarded-Host") != "example.com:443" || r.Header.Get("X-Forwarded-Method") != http.MethodConnect ||
+			r.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("Proxy-Authorization") {
+		case "Bearer opaque-token":
+			w.Header().Set("X-User", "carol")
+		case "Bearer anonymous-token":
+		case "":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer service.Close()
+
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth dave pass
+		auth_url ` + service.URL + ` {
+			user_header X-User
+			cache_ttl 1m
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(authorization string) (string, error) {
+		r, repl := newAuthRequest(authorization)
+		r.RemoteAddr = "192.0.2.1:12345"
+		err := h.checkCredentials(r)
+		id, _ := repl.GetString("http.auth.user.id")
+		return id, err
+	}
+
+	if id, err := check("Basic " + string(EncodeAuthCredentials("dave", "pass"))); err != nil || id != "dave" || calls != 0 {
+		t.Fatalf("Expected basic credentials to be checked locally, got: %v, %s, %d calls", err, id, calls)
+	}
+	for i := 0; i < 2; i++ {
+		if id, err := check("Bearer opaque-token"); err != nil || id != "carol" {
+			t.Fatalf("Expected auth_url to authenticate carol, got: %v, %s", err, id)
+		}
+		if _, err := check("Basic " + string(EncodeAuthCredentials("dave", "wrong"))); err == nil {
+			t.Fatal("Expected auth_url to deny wrong credentials")
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("Expected decisions to be cached, got %d calls", calls)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := check(""); err == nil {
+			t.Fatal("Expected an error response to deny the request")
+		}
+	}
+	if calls != 4 {
+		t.Fatalf("Expected error responses not to be cached, got %d calls", calls-2)
+	}
+	if _, err := check("Bearer anonymous-token"); err == nil || calls != 5 {
+		t.Fatal("Expected an allowed request without a user to be an error, got:", err)
+	}
+
+	r, _ := newAuthRequest("")
+	r.Method, r.URL.Host = http.MethodGet, ""
+	if err := h.checkCredentials(r); err == nil || calls != 5 {
+		t.Fatalf("Expected requests for the site itself not to be sent to auth_url, got: %v, %d calls", err, calls)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	h := Handler{
+		AuthCredentials: [][]byte{EncodeAuthCredentials("erin", "pass")},
+		AuthLockout:     &AuthLockout{MaxFailures: 2, Lockout: caddy.Duration(time.Minute)},
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	attempt := func(remoteAddr, user, pass string) int {
+		r, _ := newAuthRequest("")
+		if len(user) > 0 {
+			r.Header.Set("Proxy-Authorization", "Basic "+string(EncodeAuthCredentials(user, pass)))
+		}
+		r.RemoteAddr = remoteAddr
+		r.Host = "example.com:443"
+		w := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		})
+		if err := h.ServeHTTP(w, r, next); err != nil {
+			var handlerErr caddyhttp.HandlerError
+			if errors.As(err, &handlerErr) {
+				return handlerErr.StatusCode
+			}
+			t.Fatal(err)
+		}
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := attempt("192.0.2.1:1", "erin", "wrong"); code != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected failed attempt %d to get 407, got %d", i, code)
+		}
+	}
+	if code := attempt("192.0.2.1:2", "erin", "pass"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected locked out IP to get 429 with correct credentials, got %d", code)
+	}
+	if code := attempt("192.0.2.2:1", "erin", "pass"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected locked out user to get 429 from another IP, got %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := attempt("192.0.2.3:1", "", ""); code != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected requests without credentials to get 407, got %d", code)
+		}
+	}
+	if until := h.AuthLockout.lockedUntil([]string{"ip:192.0.2.3"}, time.Now()); !until.IsZero() {
+		t.Fatal("Expected requests without credentials not to count as failed attempts")
+	}
+
+	// a second lockout lasts twice as long
+	now := time.Now()
+	keys := []string{"ip:192.0.2.4"}
+	h.AuthLockout.failed(keys, now)
+	h.AuthLockout.failed(keys, now)
+	if until := h.AuthLockout.lockedUntil(keys, now); !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Expected a lockout of 1m, got until %v", until)
+	}
+	now = now.Add(time.Minute)
+	h.AuthLockout.failed(keys, now)
+	h.AuthLockout.failed(keys, now)
+	if until := h.AuthLockout.lockedUntil(keys, now); !until.Equal(now.Add(2 * time.Minute)) {
+		t.Fatalf("Expected a lockout of 2m, got until %v", until)
+	}
+
+	h.ProbeResistance = &ProbeResistance{}
+	if code := attempt("192.0.2.1:3", "erin", "pass"); code != http.StatusTeapot {
+		t.Fatalf("Expected locked out client to be passed through with probe resistance, got %d", code)
+	}
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer service.Close()
+	h = Handler{
+		ForwardAuth: &ForwardAuth{URL: service.URL},
+		AuthLockout: &AuthLockout{MaxFailures: 1, Lockout: caddy.Duration(time.Minute)},
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if code := attempt("192.0.2.5:1", "erin", "pass"); code != http.StatusProxyAuthRequired {
+			t.Fatalf("Expected a failing auth_url to deny the request with 407, got %d", code)
+		}
+	}
+	if until := h.AuthLockout.lockedUntil([]string{"ip:192.0.2.5", "user:erin"}, time.Now()); !until.IsZero() {
+		t.Fatal("Expected errors of auth_url not to count as failed attempts")
+	}
+}
+
+// digestAuthorization answers a Digest challenge for a CONNECT request to example.com:443.
+func digestAuthorization(challenge, username, password string, nc int) string {
+	params, _ := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	newHash := digestAlgorithms[params["algorithm"]]
+	ha1 := digestHex(newHash, username+":"+params["realm"]+":"+password)
+	ha2 := digestHex(newHash, "CONNECT:example.com:443")
+	count := fmt.Sprintf("%08x", nc)
+	response := digestHex(newHash, ha1+":"+params["nonce"]+":"+count+":c0ffee:auth:"+ha2)
+	return fmt.Sprintf(`Digest username="%s", realm=%s, nonce="%s", uri="example.com:443", algorithm=%s, `+
+		`response="%s", qop=auth, nc=%s, cnonce="c0ffee"`,
+		username, quoteAuthParam(params["realm"]), params["nonce"], params["algorithm"], response, count)
+}
+
+func TestDigestAuth(t *testing.T) {
+	legacyHA1 := digestHex(md5.New, `gina:Legacy "devices":gina-pass`)
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth helen helen-pass
+		digest_auth Office {
+			user frank frank-pass
+		}
+		digest_auth "Legacy \"devices\"" {
+			algorithms MD5
+			ha1 gina MD5 ` + legacyHA1 + `
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make(http.Header)
+	h.setAuthChallenges(header, errors.New("no credentials"))
+	challenges := header.Values("Proxy-Authenticate")
+	expectedPrefixes := []string{
+		`Digest realm="Office", qop="auth", algorithm=SHA-256, nonce=`,
+		`Digest realm="Office", qop="auth", algorithm=MD5, nonce=`,
+		`Digest realm="Legacy \"devices\"", qop="auth", algorithm=MD5, nonce=`,
+		`Basic realm="Caddy Secure Web Proxy"`,
+	}
+	if len(challenges) != len(expectedPrefixes) {
+		t.Fatalf("Expected %d challenges, got: %q", len(expectedPrefixes), challenges)
+	}
+	for i, prefix := range expectedPrefixes {
+		if !strings.HasPrefix(challenges[i], prefix) {
+			t.Fatalf("Expected challenge %d to start with %s, got: %s", i, prefix, challenges[i])
+		}
+	}
+
+	check := func(authorization string) (string, error) {
+		r, repl := newAuthRequest(authorization)
+		r.RequestURI = "example.com:443"
+		err := h.checkCredentials(r)
+		id, _ := repl.GetString("http.auth.user.id")
+		return id, err
+	}
+	for i, tc := range []struct { // the nonce of a realm is shared by its challenges
+		challenge, user, password string
+	}{
+		{challenges[0], "frank", "frank-pass"},
+		{challenges[1], "frank", "frank-pass"},
+		{challenges[1], "helen", "helen-pass"},
+		{challenges[2], "gina", "gina-pass"},
+		{challenges[2], "helen", "helen-pass"},
+	} {
+		if id, err := check(digestAuthorization(tc.challenge, tc.user, tc.password, i+1)); err != nil || id != tc.user {
+			t.Fatalf("Expected %s to be authenticated with %s, got: %v, %s", tc.user, tc.challenge, err, id)
+		}
+	}
+	if _, err := check(digestAuthorization(challenges[0], "frank", "frank-pass", 3)); err == nil {
+		t.Fatal("Expected a replayed nonce count to be rejected")
+	}
+	if _, err := check(digestAuthorization(challenges[0], "frank", "frank-pass", 6)); err != nil {
+		t.Fatal("Expected the next nonce count to be accepted, got:", err)
+	}
+	if id, err := check(digestAuthorization(challenges[0], "frank", "wrong", 7)); err == nil || id != "invalid:frank" {
+		t.Fatalf("Expected a wrong password to be rejected, got: %v, %s", err, id)
+	}
+	if _, err := check(digestAuthorization(challenges[2], "frank", "frank-pass", 8)); err == nil {
+		t.Fatal("Expected a user of another realm to be rejected")
+	}
+	// unknown users are checked against a dummy HA1, which must not let them in
+	params, _ := parseAuthParams(strings.TrimPrefix(digestAuthorization(challenges[0], "nobody", "", 9), "Digest "))
+	ha2 := digestHex(sha256.New, "CONNECT:example.com:443")
+	params["response"] = digestHex(sha256.New, string(h.DigestAuth[0].dummyHA1["SHA-256"])+":"+params["nonce"]+":"+
+		params["nc"]+":c0ffee:auth:"+ha2)
+	if _, err := h.DigestAuth[0].verify(params, http.MethodConnect, "example.com:443", time.Now()); err == nil {
+		t.Fatal("Expected an unknown user to be rejected")
+	}
+
+	params, _ = parseAuthParams(strings.TrimPrefix(digestAuthorization(challenges[0], "frank", "frank-pass", 9), "Digest "))
+	_, err := h.DigestAuth[0].verify(params, http.MethodConnect, "example.com:443", time.Now().Add(time.Hour))
+	if !errors.As(err, new(digestStaleError)) {
+		t.Fatal("Expected an expired nonce to be stale, got:", err)
+	}
+	header = make(http.Header)
+	h.setAuthChallenges(header, err)
+	if !strings.HasSuffix(header.Get("Proxy-Authenticate"), ", stale=true") {
+		t.Fatal("Expected the challenge to report the stale nonce, got:", header.Get("Proxy-Authenticate"))
+	}
+
+	// stale nonces come with correct credentials, so they do not count towards a lockout
+	h.AuthLockout = &AuthLockout{MaxFailures: 1}
+	if err = h.AuthLockout.provision(); err != nil {
+		t.Fatal(err)
+	}
+	h.DigestAuth[0].NonceLifetime = caddy.Duration(time.Nanosecond)
+	for i := 0; i < 2; i++ {
+		r, _ := newAuthRequest(digestAuthorization(challenges[0], "frank", "frank-pass", 10+i))
+		r.RequestURI = "example.com:443"
+		r.RemoteAddr = "192.0.2.1:1"
+		if err = h.authenticate(r); !errors.As(err, new(digestStaleError)) {
+			t.Fatalf("Expected attempt %d to be stale, got: %v", i, err)
+		}
+	}
+	if until := h.AuthLockout.lockedUntil([]string{"ip:192.0.2.1"}, time.Now()); !until.IsZero() {
+		t.Fatal("Expected stale nonces not to count as failed attempts")
+	}
+}
+
+func TestAuthRequiredResponse(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth ivan pass
+		digest_auth
+		bearer_auth HS256 {
+			secret s3cr3t
+		}
+		auth_realm Restricted
+		auth_challenges bearer basic digest
+		auth_required_response {
+			header Content-Type text/plain
+			header X-Proxy-Host {http.request.host}
+			body "Log in to {http.request.host}"
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.Host = "example.com:443"
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, nil); err == nil {
+		t.Fatal("Expected the authentication error to be returned after the response, as without a configured one")
+	}
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatal("Expected 407, got:", w.Code)
+	}
+	challenges := w.Header().Values("Proxy-Authenticate")
+	if len(challenges) != 4 || challenges[0] != `Bearer realm="Restricted"` || challenges[1] != `Basic realm="Restricted"` ||
+		!strings.HasPrefix(challenges[2], `Digest realm="Restricted", qop="auth", algorithm=SHA-256,`) {
+		t.Fatalf("Unexpected challenges: %q", challenges)
+	}
+	for _, challenge := range challenges {
+		if strings.Contains(challenge, "Caddy") {
+			t.Fatal("Expected the default realm to be replaced, got:", challenge)
+		}
+	}
+	if w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-Proxy-Host") != "example.com" {
+		t.Fatalf("Unexpected headers: %v", w.Header())
+	}
+	if body := w.Body.String(); body != "Log in to example.com" {
+		t.Fatal("Unexpected body:", body)
+	}
+
+	h = Handler{AuthCredentials: [][]byte{EncodeAuthCredentials("ivan", "pass")}, AuthChallenges: []string{"digest"}}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatal("Expected a digest challenge without digest_auth to be rejected")
+	}
+}
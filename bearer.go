@@ -0,0 +1,196 @@
+package forwardproxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// BearerAuth authenticates proxy clients with signed JSON Web Tokens sent as `Proxy-Authorization: Bearer <token>`.
+// Tokens must have an expiry (exp), and their subject (sub) becomes the user ID.
+type BearerAuth struct {
+	// Signature algorithm of accepted tokens: HS256, ES256 or EdDSA.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// HS256 shared secret. Either this or KeyFile is required for HS256.
+	Secret string `json:"secret,omitempty"`
+
+	// File with the HS256 shared secret, or with the PEM-encoded public key for ES256 and EdDSA.
+	KeyFile string `json:"key_file,omitempty"`
+
+	// If set, tokens must have this audience (aud).
+	Audience string `json:"audience,omitempty"`
+
+	// If set, tokens must have this issuer (iss).
+	Issuer string `json:"issuer,omitempty"`
+
+	// Allowed clock skew when checking exp and nbf. Default: 0.
+	Leeway caddy.Duration `json:"leeway,omitempty"`
+
+	secret    []byte
+	publicKey any
+}
+
+const (
+	jwtHS256 = "HS256"
+	jwtES256 = "ES256"
+	jwtEdDSA = "EdDSA"
+)
+
+func (b *BearerAuth) provision() error {
+	var keyData []byte
+	if len(b.KeyFile) > 0 {
+		var err error
+		if keyData, err = os.ReadFile(filepath.Clean(b.KeyFile)); err != nil {
+			return err
+		}
+	}
+	switch b.Algorithm {
+	case jwtHS256:
+		if len(b.Secret) > 0 {
+			b.secret = []byte(b.Secret)
+		} else {
+			b.secret = bytes.TrimSpace(keyData)
+		}
+		if len(b.secret) == 0 {
+			return errors.New("HS256 requires a secret")
+		}
+		return nil
+	case jwtES256, jwtEdDSA:
+		block, _ := pem.Decode(keyData)
+		if block == nil {
+			return fmt.Errorf("%s requires a PEM-encoded public key file", b.Algorithm)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if b.Algorithm == jwtES256 && key.Curve == elliptic.P256() {
+				b.publicKey = key
+				return nil
+			}
+		case ed25519.PublicKey:
+			if b.Algorithm == jwtEdDSA {
+				b.publicKey = key
+				return nil
+			}
+		}
+		return fmt.Errorf("public key does not match algorithm %s", b.Algorithm)
+	}
+	return fmt.Errorf("unsupported algorithm: %s", b.Algorithm)
+}
+
+// jwtClaims holds the registered claims that are checked.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verify checks the signature and the claims of token, and returns its subject.
+func (b *BearerAuth) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Algorithm != b.Algorithm { // also rejects "none"
+		return "", fmt.Errorf("unexpected token algorithm: %s", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed token signature: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	var valid bool
+	switch key := b.publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		valid = len(signature) == 64 && ecdsa.Verify(key, digest[:],
+			new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, signed, signature)
+	default:
+		mac := hmac.New(sha256.New, b.secret)
+		mac.Write(signed)
+		valid = hmac.Equal(mac.Sum(nil), signature)
+	}
+	if !valid {
+		return "", errors.New("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	leeway := time.Duration(b.Leeway)
+	if claims.ExpiresAt == nil {
+		return "", errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(leeway)) {
+		return "", errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(int64(*claims.NotBefore), 0).Add(-leeway)) {
+		return "", errors.New("token is not valid yet")
+	}
+	if len(b.Issuer) > 0 && claims.Issuer != b.Issuer {
+		return "", errors.New("unexpected token issuer")
+	}
+	if len(b.Audience) > 0 && !jwtHasAudience(claims.Audience, b.Audience) {
+		return "", errors.New("unexpected token audience")
+	}
+	if len(claims.Subject) == 0 {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtHasAudience reports whether the aud claim, a string or an array of strings, contains audience.
+func jwtHasAudience(aud json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == audience
+	}
+	var multiple []string
+	if json.Unmarshal(aud, &multiple) == nil {
+		for _, a := range multiple {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,13 +3,17 @@ package forwardproxy
 import (
 	"encoding/base64"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 
 	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/dustin/go-humanize"
 	"net"
 )
 
@@ -59,6 +63,409 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				h.AuthCredentials = [][]byte{}
 			}
 			h.AuthCredentials = append(h.AuthCredentials, EncodeAuthCredentials(args[0], args[1]))
+		case "basic_auth_hashed":
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if len(args[0]) == 0 {
+				return d.Err("empty usernames are not allowed")
+			}
+			if strings.Contains(args[0], ":") {
+				return d.Err("character ':' in usernames is not allowed")
+			}
+			if _, err := parsePasswordHash(args[1]); err != nil {
+				return d.Errf("bad password hash for %s: %v", args[0], err)
+			}
+			h.AuthUsers = append(h.AuthUsers, AuthUser{Username: args[0], Password: args[1]})
+		case "basic_auth_file":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			h.AuthFiles = append(h.AuthFiles, args[0])
+		case "basic_auth_cache":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size < 0 {
+				return d.Errf("basic_auth_cache expects a non-negative number of entries, got: %s", args[0])
+			}
+			h.AuthCacheSize = size
+		case "authentication":
+			// authentication http_basic [<hash_algorithm> [<realm>]] {
+			//     <username> <hashed_password_base64> [<salt_base64>]
+			// }
+			if len(args) == 0 || len(args) > 3 {
+				return d.ArgErr()
+			}
+			if args[0] != "http_basic" {
+				return d.Errf("only http_basic authentication can be configured in the Caddyfile, got: %s", args[0])
+			}
+			if _, ok := h.AuthenticationRaw[args[0]]; ok {
+				return d.Errf("authentication %s specified twice", args[0])
+			}
+			ba := caddyauth.HTTPBasicAuth{HashCache: new(caddyauth.Cache)}
+			hashName := "bcrypt"
+			if len(args) > 1 {
+				hashName = args[1]
+			}
+			if len(args) > 2 {
+				ba.Realm = args[2]
+			}
+			var cmp caddyauth.Comparer
+			switch hashName {
+			case "bcrypt":
+				cmp = caddyauth.BcryptHash{}
+			case "scrypt":
+				cmp = caddyauth.ScryptHash{}
+			default:
+				return d.Errf("unrecognized hash algorithm: %s", hashName)
+			}
+			ba.HashRaw = caddyconfig.JSONModuleObject(cmp, "algorithm", hashName, nil)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				username := d.Val()
+				var b64Pwd, b64Salt string
+				d.Args(&b64Pwd, &b64Salt)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if username == "" || b64Pwd == "" {
+					return d.Err("username and password cannot be empty or missing")
+				}
+				ba.AccountList = append(ba.AccountList, caddyauth.Account{
+					Username: username,
+					Password: b64Pwd,
+					Salt:     b64Salt,
+				})
+			}
+			if h.AuthenticationRaw == nil {
+				h.AuthenticationRaw = make(caddy.ModuleMap)
+			}
+			h.AuthenticationRaw[args[0]] = caddyconfig.JSON(ba, nil)
+		case "bearer_auth":
+			// bearer_auth <algorithm> {
+			//     secret <secret> | key_file <path>
+			//     audience <aud>
+			//     issuer <iss>
+			//     leeway <duration>
+			// }
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.BearerAuth != nil {
+				return d.Err("bearer_auth subdirective specified twice")
+			}
+			h.BearerAuth = &BearerAuth{Algorithm: args[0]}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				switch option {
+				case "secret":
+					h.BearerAuth.Secret = value
+				case "key_file":
+					h.BearerAuth.KeyFile = value
+				case "audience":
+					h.BearerAuth.Audience = value
+				case "issuer":
+					h.BearerAuth.Issuer = value
+				case "leeway":
+					leeway, err := caddy.ParseDuration(value)
+					if err != nil || leeway < 0 {
+						return d.Errf("bad leeway: %s", value)
+					}
+					h.BearerAuth.Leeway = caddy.Duration(leeway)
+				default:
+					return d.Errf("unrecognized bearer_auth option: %s", option)
+				}
+			}
+		case "client_cert_auth":
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			if h.ClientCertAuth != nil {
+				return d.Err("client_cert_auth subdirective specified twice")
+			}
+			h.ClientCertAuth = &ClientCertAuth{}
+			if len(args) == 1 {
+				if _, ok := clientCertUsernameFields[args[0]]; !ok {
+					return d.Errf("unsupported client certificate username field: %s", args[0])
+				}
+				h.ClientCertAuth.Username = args[0]
+			}
+		case "auth_url":
+			// auth_url <url> {
+			//     user_header <header>
+			//     cache_ttl <duration>
+			//     timeout <duration>
+			// }
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if h.ForwardAuth != nil {
+				return d.Err("auth_url subdirective specified twice")
+			}
+			h.ForwardAuth = &ForwardAuth{URL: args[0]}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				switch option {
+				case "user_header":
+					h.ForwardAuth.UserHeader = value
+				case "cache_ttl", "timeout":
+					duration, err := caddy.ParseDuration(value)
+					if err != nil || duration < 0 {
+						return d.Errf("bad %s: %s", option, value)
+					}
+					if option == "cache_ttl" {
+						h.ForwardAuth.CacheTTL = caddy.Duration(duration)
+					} else {
+						h.ForwardAuth.Timeout = caddy.Duration(duration)
+					}
+				default:
+					return d.Errf("unrecognized auth_url option: %s", option)
+				}
+			}
+		case "digest_auth":
+			// digest_auth [<realm>] {
+			//     algorithms <algorithm...>
+			//     user <username> <password>
+			//     ha1 <username> <algorithm> <hex>
+			//     nonce_lifetime <duration>
+			// }
+			if len(args) > 1 {
+				return d.ArgErr()
+			}
+			realm := &DigestAuth{}
+			if len(args) == 1 {
+				realm.Realm = args[0]
+			}
+			users := make(map[string]int)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				optionArgs := d.RemainingArgs()
+				switch option {
+				case "algorithms":
+					if len(optionArgs) == 0 {
+						return d.ArgErr()
+					}
+					for _, algorithm := range optionArgs {
+						if _, ok := digestAlgorithms[algorithm]; !ok {
+							return d.Errf("unsupported digest algorithm: %s", algorithm)
+						}
+					}
+					realm.Algorithms = optionArgs
+				case "user", "ha1":
+					if option == "user" && len(optionArgs) != 2 || option == "ha1" && len(optionArgs) != 3 {
+						return d.ArgErr()
+					}
+					i, ok := users[optionArgs[0]]
+					if !ok {
+						i = len(realm.Users)
+						users[optionArgs[0]] = i
+						realm.Users = append(realm.Users, DigestUser{Username: optionArgs[0]})
+					}
+					if option == "user" {
+						realm.Users[i].Password = optionArgs[1]
+					} else {
+						if realm.Users[i].HA1 == nil {
+							realm.Users[i].HA1 = make(map[string]string)
+						}
+						realm.Users[i].HA1[optionArgs[1]] = optionArgs[2]
+					}
+				case "nonce_lifetime":
+					if len(optionArgs) != 1 {
+						return d.ArgErr()
+					}
+					lifetime, err := caddy.ParseDuration(optionArgs[0])
+					if err != nil || lifetime <= 0 {
+						return d.Errf("bad nonce_lifetime: %s", optionArgs[0])
+					}
+					realm.NonceLifetime = caddy.Duration(lifetime)
+				default:
+					return d.Errf("unrecognized digest_auth option: %s", option)
+				}
+			}
+			h.DigestAuth = append(h.DigestAuth, realm)
+		case "auth_realm":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			h.AuthRealm = args[0]
+		case "auth_challenges":
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, scheme := range args {
+				if scheme != "basic" && scheme != "digest" && scheme != "bearer" {
+					return d.Errf("unsupported challenge scheme: %s", scheme)
+				}
+			}
+			h.AuthChallenges = args
+		case "auth_required_response":
+			// auth_required_response {
+			//     header <name> <value...>
+			//     body <body> | body_file <path>
+			// }
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.AuthRequiredResponse = &AuthRequiredResponse{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				optionArgs := d.RemainingArgs()
+				switch option {
+				case "header":
+					if len(optionArgs) < 2 {
+						return d.ArgErr()
+					}
+					if h.AuthRequiredResponse.Headers == nil {
+						h.AuthRequiredResponse.Headers = make(http.Header)
+					}
+					for _, value := range optionArgs[1:] {
+						h.AuthRequiredResponse.Headers.Add(optionArgs[0], value)
+					}
+				case "body":
+					if len(optionArgs) != 1 {
+						return d.ArgErr()
+					}
+					h.AuthRequiredResponse.Body = optionArgs[0]
+				case "body_file":
+					if len(optionArgs) != 1 {
+						return d.ArgErr()
+					}
+					h.AuthRequiredResponse.BodyFile = optionArgs[0]
+				default:
+					return d.Errf("unrecognized auth_required_response option: %s", option)
+				}
+			}
+		case "rate_limit":
+			// rate_limit <key> <rate>[/<window>] [<burst>]
+			if len(args) != 2 && len(args) != 3 {
+				return d.ArgErr()
+			}
+			limit := &RateLimit{Key: args[0]}
+			rate, window, hasWindow := strings.Cut(args[1], "/")
+			var err error
+			if limit.Rate, err = strconv.Atoi(rate); err != nil || limit.Rate <= 0 {
+				return d.Errf("rate limit expects a positive rate, got: %s", rate)
+			}
+			if hasWindow {
+				duration, err := caddy.ParseDuration(window)
+				if err != nil || duration <= 0 {
+					return d.Errf("bad rate limit window: %s", window)
+				}
+				limit.Window = caddy.Duration(duration)
+			}
+			if len(args) == 3 {
+				if limit.Burst, err = strconv.Atoi(args[2]); err != nil || limit.Burst <= 0 {
+					return d.Errf("rate limit expects a positive burst, got: %s", args[2])
+				}
+			}
+			h.RateLimits = append(h.RateLimits, limit)
+		case "user_quota":
+			// user_quota {
+			//     max_tunnels <count>
+			//     bandwidth <bits per second>
+			//     daily <bytes>
+			//     monthly <bytes>
+			//     state_file <path>
+			//     save_interval <duration>
+			// }
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.UserQuota = &UserQuota{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				switch option {
+				case "max_tunnels":
+					count, err := strconv.Atoi(value)
+					if err != nil || count <= 0 {
+						return d.Errf("max_tunnels expects a positive number, got: %s", value)
+					}
+					h.UserQuota.MaxTunnels = count
+				case "bandwidth":
+					// e.g. 10Mbit
+					bits, err := humanize.ParseBytes(strings.TrimSuffix(value, "bit"))
+					if err != nil || bits == 0 {
+						return d.Errf("bad bandwidth: %s", value)
+					}
+					h.UserQuota.Bandwidth = int64(bits)
+				case "daily", "monthly":
+					bytes, err := humanize.ParseBytes(value)
+					if err != nil || bytes == 0 {
+						return d.Errf("bad %s quota: %s", option, value)
+					}
+					if option == "daily" {
+						h.UserQuota.DailyBytes = int64(bytes)
+					} else {
+						h.UserQuota.MonthlyBytes = int64(bytes)
+					}
+				case "state_file":
+					h.UserQuota.StateFile = value
+				case "save_interval":
+					interval, err := caddy.ParseDuration(value)
+					if err != nil || interval <= 0 {
+						return d.Errf("bad save_interval: %s", value)
+					}
+					h.UserQuota.SaveInterval = caddy.Duration(interval)
+				default:
+					return d.Errf("unrecognized user_quota option: %s", option)
+				}
+			}
+		case "auth_lockout":
+			// auth_lockout {
+			//     max_failures <count>
+			//     lockout <duration>
+			//     max_lockout <duration>
+			//     tarpit <duration>
+			// }
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			if h.AuthLockout != nil {
+				return d.Err("auth_lockout subdirective specified twice")
+			}
+			h.AuthLockout = &AuthLockout{}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				if option == "max_failures" {
+					count, err := strconv.Atoi(value)
+					if err != nil || count <= 0 {
+						return d.Errf("max_failures expects a positive number, got: %s", value)
+					}
+					h.AuthLockout.MaxFailures = count
+					continue
+				}
+				duration, err := caddy.ParseDuration(value)
+				if err != nil || duration < 0 {
+					return d.Errf("bad %s: %s", option, value)
+				}
+				switch option {
+				case "lockout":
+					h.AuthLockout.Lockout = caddy.Duration(duration)
+				case "max_lockout":
+					h.AuthLockout.MaxLockout = caddy.Duration(duration)
+				case "tarpit":
+					h.AuthLockout.Tarpit = caddy.Duration(duration)
+				default:
+					return d.Errf("unrecognized auth_lockout option: %s", option)
+				}
+			}
 		case "hosts":
 			if len(args) == 0 {
 				return d.ArgErr()
@@ -105,11 +512,68 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			} else {
 				h.ProbeResistance = &ProbeResistance{}
 			}
+			// probe_resistance [secretlink.tld] {
+			//     auth_padding <duration>
+			//     auth_jitter <duration>
+			//     page {
+			//         status <code>
+			//         header <name> <value...>
+			//         body <body> | body_file <path>
+			//     }
+			//     knock <path...>
+			//     unlock_duration <duration>
+			//     knock_timeout <duration>
+			// }
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				option := d.Val()
+				if option == "knock" {
+					paths := d.RemainingArgs()
+					if len(paths) == 0 {
+						return d.ArgErr()
+					}
+					h.ProbeResistance.KnockPaths = append(h.ProbeResistance.KnockPaths, paths...)
+					continue
+				}
+				if option == "page" {
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					if h.ProbeResistance.Page != nil {
+						return d.Err("page specified twice")
+					}
+					page, err := parseHiddenPage(d)
+					if err != nil {
+						return err
+					}
+					h.ProbeResistance.Page = page
+					continue
+				}
+				var value string
+				if !d.AllArgs(&value) {
+					return d.ArgErr()
+				}
+				duration, err := caddy.ParseDuration(value)
+				if err != nil || duration < 0 {
+					return d.Errf("bad %s: %s", option, value)
+				}
+				switch option {
+				case "auth_padding":
+					h.ProbeResistance.AuthPadding = caddy.Duration(duration)
+				case "auth_jitter":
+					h.ProbeResistance.AuthJitter = caddy.Duration(duration)
+				case "unlock_duration":
+					h.ProbeResistance.UnlockDuration = caddy.Duration(duration)
+				case "knock_timeout":
+					h.ProbeResistance.KnockTimeout = caddy.Duration(duration)
+				default:
+					return d.Errf("unrecognized probe_resistance option: %s", option)
+				}
+			}
 		case "serve_pac":
 			if len(args) > 1 {
 				return d.ArgErr()
 			}
-			if len(h.PACPath) != 0 {
+			if len(h.PACPath) != 0 || h.PAC != nil {
 				return d.Err("serve_pac subdirective specified twice")
 			}
 			if len(args) == 1 {
@@ -120,6 +584,58 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			} else {
 				h.PACPath = "/proxy.pac"
 			}
+			// serve_pac [/path.pac] {
+			//     proxy <type> <host:port> | DIRECT
+			//     bypass <destination...>
+			//     only <destination...>
+			//     use_acl
+			//     per_user <path/> <secret>
+			//     wpad <host...>
+			// }
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				if h.PAC == nil {
+					h.PAC = &PACConfig{}
+				}
+				option := d.Val()
+				optionArgs := d.RemainingArgs()
+				switch option {
+				case "proxy":
+					if len(optionArgs) == 0 {
+						return d.ArgErr()
+					}
+					h.PAC.Proxies = append(h.PAC.Proxies, strings.Join(optionArgs, " "))
+				case "bypass":
+					if len(optionArgs) == 0 {
+						return d.ArgErr()
+					}
+					h.PAC.Bypass = append(h.PAC.Bypass, optionArgs...)
+				case "only":
+					if len(optionArgs) == 0 {
+						return d.ArgErr()
+					}
+					h.PAC.Only = append(h.PAC.Only, optionArgs...)
+				case "use_acl":
+					if len(optionArgs) != 0 {
+						return d.ArgErr()
+					}
+					h.PAC.UseACL = true
+				case "per_user":
+					if len(optionArgs) != 2 {
+						return d.ArgErr()
+					}
+					h.PAC.UserPath, h.PAC.UserSecret = optionArgs[0], optionArgs[1]
+				case "wpad":
+					if len(optionArgs) == 0 {
+						return d.ArgErr()
+					}
+					h.PAC.WPADHosts = append(h.PAC.WPADHosts, optionArgs...)
+				default:
+					return d.Errf("unrecognized serve_pac option: %s", option)
+				}
+			}
+			if len(args) == 0 && h.PAC != nil && (len(h.PAC.UserPath) > 0 || len(h.PAC.WPADHosts) > 0) {
+				h.PACPath = "" // only serve per-user and WPAD PAC files, unless a path is given
+			}
 		case "dial_timeout":
 			if len(args) != 1 {
 				return d.ArgErr()
@@ -133,13 +649,56 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			h.DialTimeout = caddy.Duration(timeout)
 		case "upstream":
-			if len(args) != 1 {
+			if len(args) == 0 {
 				return d.ArgErr()
 			}
-			if h.Upstream != "" {
+			if h.Upstream != "" || h.UpstreamPool != nil {
 				return d.Err("upstream directive specified more than once")
 			}
-			h.Upstream = args[0]
+			pool, err := parseUpstreamPool(d, args)
+			if err != nil {
+				return err
+			}
+			if pool == nil {
+				h.Upstream = args[0]
+			} else {
+				h.UpstreamPool = pool
+			}
+		case "upstream_pool":
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if _, ok := h.UpstreamPools[args[0]]; ok {
+				return d.Errf("upstream_pool %s specified more than once", args[0])
+			}
+			pool, err := parseUpstreamPool(d, args[1:])
+			if err != nil {
+				return err
+			}
+			if pool == nil {
+				pool = &UpstreamPool{URLs: args[1:]}
+			}
+			if h.UpstreamPools == nil {
+				h.UpstreamPools = make(map[string]*UpstreamPool)
+			}
+			h.UpstreamPools[args[0]] = pool
+		case "route":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			route, err := parseRouteRule(d, args[0])
+			if err != nil {
+				return err
+			}
+			h.Routes = append(h.Routes, route)
+		case "upstream_acl":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			if args[0] != upstreamACLHostname && args[0] != upstreamACLResolve {
+				return d.Errf("upstream_acl expects %s or %s, got: %s", upstreamACLHostname, upstreamACLResolve, args[0])
+			}
+			h.UpstreamACL = args[0]
 		case "acl":
 			for nesting := d.Nesting(); d.NextBlock(nesting); {
 				aclDirective := d.Val()
@@ -147,12 +706,12 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if len(args) == 0 {
 					return d.ArgErr()
 				}
-				var ruleSubjects []string
+				var ruleSubjects, ruleSources []string
 				var err error
 				aclAllow := false
 				switch aclDirective {
 				case "allow":
-					ruleSubjects = args
+					ruleSubjects, ruleSources = args, dispenserSources(d, len(args))
 					aclAllow = true
 				case "allow_file":
 					if len(args) != 1 {
@@ -162,9 +721,10 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					if err != nil {
 						return err
 					}
+					ruleSources = fileSources(args[0], len(ruleSubjects))
 					aclAllow = true
 				case "deny":
-					ruleSubjects = args
+					ruleSubjects, ruleSources = args, dispenserSources(d, len(args))
 				case "deny_file":
 					if len(args) != 1 {
 						return d.Err("denyfile accepts a single filename argument")
@@ -173,13 +733,46 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					if err != nil {
 						return err
 					}
+					ruleSources = fileSources(args[0], len(ruleSubjects))
 				default:
 					return d.Err("expected acl directive: allow/allowfile/deny/denyfile." +
 						"got: " + aclDirective)
 				}
-				ar := ACLRule{Subjects: ruleSubjects, Allow: aclAllow}
+				ar := ACLRule{Subjects: ruleSubjects, Allow: aclAllow, Sources: ruleSources}
 				h.ACL = append(h.ACL, ar)
 			}
+		case "inspect_tunnel":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.InspectTunnel = true
+		case "category_database":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			h.CategoryDatabases = append(h.CategoryDatabases, args[0])
+		case "geoip_database":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			h.GeoIPDatabases = append(h.GeoIPDatabases, args[0])
+		case "database_reload_interval":
+			if len(args) != 1 {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.ArgErr()
+			}
+			if interval <= 0 {
+				return d.Err("database_reload_interval must be positive")
+			}
+			h.DatabaseReloadInterval = caddy.Duration(interval)
+		case "acl_debug_header":
+			if len(args) != 0 {
+				return d.ArgErr()
+			}
+			h.ACLDebugHeader = true
 		case "bind":
 			if len(args) != 1 {
 				return d.ArgErr()
@@ -211,3 +804,146 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	}
 	return nil
 }
+
+// dispenserSources returns the Caddyfile position of the current line, once for each of n subjects on it.
+func dispenserSources(d *caddyfile.Dispenser, n int) []string {
+	source := d.File() + ":" + strconv.Itoa(d.Line())
+	sources := make([]string, n)
+	for i := range sources {
+		sources[i] = source
+	}
+	return sources
+}
+
+// fileSources returns file:line for each of n lines read from filename.
+func fileSources(filename string, n int) []string {
+	sources := make([]string, n)
+	for i := range sources {
+		sources[i] = filename + ":" + strconv.Itoa(i+1)
+	}
+	return sources
+}
+
+// parseHiddenPage parses the page block of probe_resistance.
+func parseHiddenPage(d *caddyfile.Dispenser) (*HiddenPage, error) {
+	page := &HiddenPage{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		optionArgs := d.RemainingArgs()
+		switch option {
+		case "status":
+			if len(optionArgs) != 1 {
+				return nil, d.ArgErr()
+			}
+			status, err := strconv.Atoi(optionArgs[0])
+			if err != nil {
+				return nil, d.Errf("bad status: %s", optionArgs[0])
+			}
+			page.Status = status
+		case "header":
+			if len(optionArgs) < 2 {
+				return nil, d.ArgErr()
+			}
+			if page.Headers == nil {
+				page.Headers = make(http.Header)
+			}
+			for _, value := range optionArgs[1:] {
+				page.Headers.Add(optionArgs[0], value)
+			}
+		case "body":
+			if len(optionArgs) != 1 {
+				return nil, d.ArgErr()
+			}
+			page.Body = optionArgs[0]
+		case "body_file":
+			if len(optionArgs) != 1 {
+				return nil, d.ArgErr()
+			}
+			page.BodyFile = optionArgs[0]
+		default:
+			return nil, d.Errf("unrecognized page option: %s", option)
+		}
+	}
+	return page, nil
+}
+
+// parseUpstreamPool parses the block of upstream, with the given URLs.
+// It returns nil for a single URL without a block, which is a plain Upstream.
+func parseUpstreamPool(d *caddyfile.Dispenser, urls []string) (*UpstreamPool, error) {
+	pool := &UpstreamPool{URLs: urls}
+	hasBlock := false
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		hasBlock = true
+		option := d.Val()
+		optionArgs := d.RemainingArgs()
+		if len(optionArgs) != 1 {
+			return nil, d.ArgErr()
+		}
+		switch option {
+		case "policy":
+			pool.Policy = optionArgs[0]
+		case "health_check":
+			pool.HealthCheckTarget = optionArgs[0]
+		case "health_interval", "health_timeout", "fail_duration":
+			duration, err := caddy.ParseDuration(optionArgs[0])
+			if err != nil {
+				return nil, d.Errf("bad %s: %s", option, optionArgs[0])
+			}
+			switch option {
+			case "health_interval":
+				pool.HealthCheckInterval = caddy.Duration(duration)
+			case "health_timeout":
+				pool.HealthCheckTimeout = caddy.Duration(duration)
+			default:
+				pool.FailDuration = caddy.Duration(duration)
+			}
+		case "max_fails", "retries":
+			count, err := strconv.Atoi(optionArgs[0])
+			if err != nil || count < 0 {
+				return nil, d.Errf("bad %s: %s", option, optionArgs[0])
+			}
+			if option == "max_fails" {
+				pool.MaxFails = count
+			} else {
+				pool.Retries = &count
+			}
+		default:
+			return nil, d.Errf("unrecognized upstream option: %s", option)
+		}
+	}
+	if len(urls) == 1 && !hasBlock {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// parseRouteRule parses the block of route, which sends the destinations it matches to upstream.
+func parseRouteRule(d *caddyfile.Dispenser, upstream string) (RouteRule, error) {
+	route := RouteRule{Upstream: upstream}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		optionArgs := d.RemainingArgs()
+		if len(optionArgs) == 0 {
+			return route, d.ArgErr()
+		}
+		switch option {
+		case "to":
+			route.Destinations = append(route.Destinations, optionArgs...)
+		case "port":
+			for _, arg := range optionArgs {
+				port, err := strconv.Atoi(arg)
+				if err != nil {
+					return route, d.Errf("bad port: %s", arg)
+				}
+				route.Ports = append(route.Ports, port)
+			}
+		case "user":
+			route.Users = append(route.Users, optionArgs...)
+		case "source":
+			route.Sources = append(route.Sources, optionArgs...)
+		default:
+			return route, d.Errf("unrecognized route option: %s", option)
+		}
+	}
+	return route, nil
+}
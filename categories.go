@@ -0,0 +1,65 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// categoryDB maps domains to categories, as loaded from local files with one `domain,category` entry per line.
+// An entry applies to the domain and all of its subdomains. Empty lines and lines starting with # are ignored.
+type categoryDB struct {
+	paths []string
+	trie  atomic.Pointer[domainTrie]
+}
+
+func newCategoryDB(paths []string) (*categoryDB, error) {
+	db := &categoryDB{paths: paths}
+	return db, db.reload()
+}
+
+// reload replaces the database with the current contents of its files, or leaves it as is if they cannot be loaded.
+func (db *categoryDB) reload() error {
+	trie := newDomainTrie()
+	for _, path := range db.paths {
+		if err := loadCategoryFile(trie, path); err != nil {
+			return err
+		}
+	}
+	db.trie.Store(trie)
+	return nil
+}
+
+// hasCategory reports whether domain belongs to category.
+func (db *categoryDB) hasCategory(domain, category string) bool {
+	return db.trie.Load().contains(domain, category)
+}
+
+func loadCategoryFile(trie *domainTrie, path string) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if len(entry) == 0 || entry[0] == '#' {
+			continue
+		}
+		domain, category, ok := strings.Cut(entry, ",")
+		domain, category = strings.TrimSpace(domain), strings.ToLower(strings.TrimSpace(category))
+		if !ok || len(category) == 0 {
+			return fmt.Errorf("%s:%d: expected domain,category", path, line)
+		}
+		if err = isValidDomainLite(normalizeDomain(domain)); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		trie.insert(domain, category)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,123 @@
+package forwardproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultRealm is the realm of authentication challenges if none is configured.
+const defaultRealm = "Caddy Secure Web Proxy"
+
+// AuthRequiredResponse replaces the response asking clients for credentials (407 Proxy Authentication Required).
+// Header values and the body may contain placeholders, such as {http.request.host} or {http.auth.user.id}.
+type AuthRequiredResponse struct {
+	// Headers to set, after the challenges, which they may override (e.g. Content-Type or Proxy-Authenticate).
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Response body.
+	Body string `json:"body,omitempty"`
+
+	// File with the response body, read once at startup, instead of Body.
+	BodyFile string `json:"body_file,omitempty"`
+}
+
+func (a *AuthRequiredResponse) provision() error {
+	if len(a.BodyFile) > 0 {
+		if len(a.Body) > 0 {
+			return errors.New("body and body_file cannot be used together")
+		}
+		body, err := os.ReadFile(filepath.Clean(a.BodyFile))
+		if err != nil {
+			return err
+		}
+		a.Body = string(body)
+	}
+	return nil
+}
+
+// validateAuthChallenges checks that every scheme of AuthChallenges can be challenged for.
+func (h Handler) validateAuthChallenges() error {
+	seen := make(map[string]bool)
+	for _, scheme := range h.AuthChallenges {
+		switch scheme {
+		case "basic":
+		case "digest":
+			if len(h.DigestAuth) == 0 {
+				return errors.New("digest challenge requires digest_auth")
+			}
+		case "bearer":
+			if h.BearerAuth == nil {
+				return errors.New("bearer challenge requires bearer_auth")
+			}
+		default:
+			return fmt.Errorf("unsupported challenge scheme: %s", scheme)
+		}
+		if seen[scheme] {
+			return fmt.Errorf("challenge scheme %s is listed more than once", scheme)
+		}
+		seen[scheme] = true
+	}
+	return nil
+}
+
+// setAuthChallenges asks the client for credentials, with the schemes of AuthChallenges in order.
+// By default, that is Digest in every realm (if any), and Basic unless only Digest credentials could be checked.
+// A stale nonce in authErr is signalled to the client.
+func (h Handler) setAuthChallenges(header http.Header, authErr error) {
+	schemes := h.AuthChallenges
+	if len(schemes) == 0 {
+		if len(h.DigestAuth) > 0 {
+			schemes = append(schemes, "digest")
+		}
+		if len(h.DigestAuth) == 0 || h.AuthCredentials != nil || h.passwordHashes != nil || h.authProviders != nil ||
+			h.ForwardAuth != nil {
+			schemes = append(schemes, "basic")
+		}
+	}
+	stale := errors.As(authErr, new(digestStaleError))
+	for _, scheme := range schemes {
+		switch scheme {
+		case "basic":
+			header.Add("Proxy-Authenticate", "Basic realm="+quoteAuthParam(h.AuthRealm))
+		case "digest":
+			for _, realm := range h.DigestAuth {
+				for _, challenge := range realm.challenges(stale) {
+					header.Add("Proxy-Authenticate", challenge)
+				}
+			}
+		case "bearer":
+			header.Add("Proxy-Authenticate", "Bearer realm="+quoteAuthParam(h.AuthRealm))
+		}
+	}
+}
+
+// writeAuthRequired responds with 407 Proxy Authentication Required, or the configured AuthRequiredResponse.
+// fallbackBody is written if there is no configured response; if it is empty, the error is left to Caddy instead.
+// Once a response is written, authErr is returned either way, so that the failure is logged alike.
+func (h Handler) writeAuthRequired(w http.ResponseWriter, r *http.Request, authErr error, fallbackBody string) error {
+	h.setAuthChallenges(w.Header(), authErr)
+	if h.AuthRequiredResponse == nil {
+		if len(fallbackBody) == 0 {
+			return caddyhttp.Error(http.StatusProxyAuthRequired, authErr)
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		_, _ = w.Write([]byte(fallbackBody))
+		return authErr
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for name, values := range h.AuthRequiredResponse.Headers {
+		w.Header().Del(name)
+		for _, value := range values {
+			w.Header().Add(name, repl.ReplaceKnown(value, ""))
+		}
+	}
+	w.WriteHeader(http.StatusProxyAuthRequired)
+	_, _ = w.Write([]byte(repl.ReplaceKnown(h.AuthRequiredResponse.Body, "")))
+	return authErr
+}
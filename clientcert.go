@@ -0,0 +1,69 @@
+package forwardproxy
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// ClientCertAuth authenticates proxy clients by the TLS client certificate that the server verified.
+// Certificates are only verified if the TLS connection policy of the server has client authentication
+// with trusted CAs, in mode verify_if_given or require_and_verify.
+type ClientCertAuth struct {
+	// Which field of the certificate becomes the user ID:
+	//   - cn: the subject common name (default)
+	//   - dns: the first DNS name SAN
+	//   - email: the first email address SAN
+	//   - uri: the first URI SAN
+	//   - spiffe: the first URI SAN with the spiffe scheme, e.g. spiffe://example.org/laptop/alice
+	Username string `json:"username,omitempty"`
+}
+
+var clientCertUsernameFields = map[string]func(*x509.Certificate) string{
+	"cn": func(cert *x509.Certificate) string {
+		return cert.Subject.CommonName
+	},
+	"dns": func(cert *x509.Certificate) string {
+		if len(cert.DNSNames) == 0 {
+			return ""
+		}
+		return cert.DNSNames[0]
+	},
+	"email": func(cert *x509.Certificate) string {
+		if len(cert.EmailAddresses) == 0 {
+			return ""
+		}
+		return cert.EmailAddresses[0]
+	},
+	"uri": func(cert *x509.Certificate) string {
+		if len(cert.URIs) == 0 {
+			return ""
+		}
+		return cert.URIs[0].String()
+	},
+	"spiffe": func(cert *x509.Certificate) string {
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" && len(uri.Host) > 0 {
+				return uri.String()
+			}
+		}
+		return ""
+	},
+}
+
+func (c *ClientCertAuth) provision() error {
+	if len(c.Username) == 0 {
+		c.Username = "cn"
+	}
+	if _, ok := clientCertUsernameFields[c.Username]; !ok {
+		return fmt.Errorf("unsupported username field: %s", c.Username)
+	}
+	return nil
+}
+
+// username maps the verified client certificate to a user, or returns "" if the certificate doesn't name one.
+func (c *ClientCertAuth) username(verifiedChains [][]*x509.Certificate) string {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return ""
+	}
+	return clientCertUsernameFields[c.Username](verifiedChains[0][0])
+}
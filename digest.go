@@ -0,0 +1,308 @@
+package forwardproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// DigestAuth accepts RFC 7616 Digest credentials (with qop=auth) in one realm.
+type DigestAuth struct {
+	// Default: the AuthRealm of the handler.
+	Realm string `json:"realm,omitempty"`
+
+	// Accepted algorithms, in order of preference: SHA-256 and/or MD5. Default: both.
+	Algorithms []string `json:"algorithms,omitempty"`
+
+	// Users of this realm. Users of basic_auth (AuthCredentials) are accepted too.
+	Users []DigestUser `json:"users,omitempty"`
+
+	// How long a nonce can be used before the client is asked to get a fresh one. Default: 5m.
+	NonceLifetime caddy.Duration `json:"nonce_lifetime,omitempty"`
+
+	ha1       map[string]map[string][]byte // by algorithm, then by username
+	dummyHA1  map[string][]byte            // by algorithm, checked for unknown users
+	nonceKey  []byte
+	mu        sync.Mutex
+	nonceUses map[string]*digestNonceUse // by nonce
+	nextSweep int
+}
+
+// DigestUser is a user of a Digest realm, with either a plaintext password or precomputed hashes.
+type DigestUser struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// H(username:realm:password) in hex, by algorithm, as in htdigest files.
+	HA1 map[string]string `json:"ha1,omitempty"`
+}
+
+type digestNonceUse struct {
+	count   uint64
+	expires time.Time
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"SHA-256": sha256.New,
+	"MD5":     md5.New,
+}
+
+// digestStaleError reports correct credentials computed with an expired nonce.
+type digestStaleError struct{}
+
+func (digestStaleError) Error() string {
+	return "stale digest nonce"
+}
+
+func (a *DigestAuth) provision(defaultRealm string, basicCredentials [][]byte) error {
+	if len(a.Realm) == 0 {
+		a.Realm = defaultRealm
+	}
+	if len(a.Algorithms) == 0 {
+		a.Algorithms = []string{"SHA-256", "MD5"}
+	}
+	if a.NonceLifetime <= 0 {
+		a.NonceLifetime = caddy.Duration(5 * time.Minute)
+	}
+	users := a.Users
+	for _, creds := range basicCredentials {
+		decoded, err := base64.StdEncoding.DecodeString(string(creds))
+		if err != nil {
+			return err
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		users = append(users[:len(users):len(users)], DigestUser{Username: username, Password: password})
+	}
+	a.ha1 = make(map[string]map[string][]byte)
+	a.dummyHA1 = make(map[string][]byte)
+	for _, algorithm := range a.Algorithms {
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			return fmt.Errorf("unsupported algorithm: %s", algorithm)
+		}
+		a.dummyHA1[algorithm] = []byte(digestHex(newHash, ":"+a.Realm+":"))
+		table := make(map[string][]byte, len(users))
+		for _, user := range users {
+			if len(user.Username) == 0 || strings.ContainsAny(user.Username, ":\"") {
+				return fmt.Errorf("invalid username: %q", user.Username)
+			}
+			if _, ok := table[user.Username]; ok {
+				return fmt.Errorf("user %s is defined more than once", user.Username)
+			}
+			if hexHA1, ok := user.HA1[algorithm]; ok {
+				ha1, err := hex.DecodeString(hexHA1)
+				if err != nil || len(ha1) != newHash().Size() {
+					return fmt.Errorf("user %s: malformed %s HA1", user.Username, algorithm)
+				}
+				table[user.Username] = []byte(strings.ToLower(hexHA1))
+			} else if len(user.Password) > 0 {
+				table[user.Username] = []byte(digestHex(newHash, user.Username+":"+a.Realm+":"+user.Password))
+			} else if len(user.HA1) == 0 {
+				return fmt.Errorf("user %s has no password", user.Username)
+			}
+		}
+		a.ha1[algorithm] = table
+	}
+	a.nonceKey = make([]byte, 32)
+	if _, err := rand.Read(a.nonceKey); err != nil {
+		return err
+	}
+	a.nonceUses = make(map[string]*digestNonceUse)
+	return nil
+}
+
+func digestHex(newHash func() hash.Hash, data string) string {
+	h := newHash()
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newNonce returns a nonce that can be checked without remembering it: its issue time, random bytes and a MAC.
+func (a *DigestAuth) newNonce(now time.Time) string {
+	nonce := make([]byte, 16, 32)
+	binary.BigEndian.PutUint64(nonce, uint64(now.UnixNano()))
+	_, _ = rand.Read(nonce[8:16])
+	return base64.RawURLEncoding.EncodeToString(append(nonce, a.nonceMAC(nonce)...))
+}
+
+func (a *DigestAuth) nonceMAC(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, a.nonceKey)
+	mac.Write(nonce)
+	return mac.Sum(nil)[:16]
+}
+
+// nonceIssued returns when nonce was issued, or false if it was not issued by this realm.
+func (a *DigestAuth) nonceIssued(nonce string) (time.Time, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(decoded) != 32 || !hmac.Equal(a.nonceMAC(decoded[:16]), decoded[16:]) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(decoded))), true
+}
+
+// challenges returns the values of Proxy-Authenticate for this realm, one per algorithm.
+func (a *DigestAuth) challenges(stale bool) []string {
+	nonce := a.newNonce(time.Now())
+	values := make([]string, len(a.Algorithms))
+	for i, algorithm := range a.Algorithms {
+		values[i] = fmt.Sprintf("Digest realm=%s, qop=\"auth\", algorithm=%s, nonce=\"%s\"",
+			quoteAuthParam(a.Realm), algorithm, nonce)
+		if stale {
+			values[i] += ", stale=true"
+		}
+	}
+	return values
+}
+
+// verify checks the Digest credentials in params, and returns the username they claim.
+func (a *DigestAuth) verify(params map[string]string, method, requestURI string, now time.Time) (string, error) {
+	username := params["username"]
+	algorithm := params["algorithm"]
+	if len(algorithm) == 0 {
+		algorithm = "MD5"
+	}
+	table, ok := a.ha1[algorithm]
+	if !ok {
+		return username, fmt.Errorf("algorithm %s is not accepted", algorithm)
+	}
+	if params["qop"] != "auth" || params["userhash"] == "true" {
+		return username, errors.New("only qop=auth without userhash is supported")
+	}
+	if params["uri"] != requestURI {
+		return username, errors.New("digest uri does not match the request")
+	}
+	nonce := params["nonce"]
+	issued, ok := a.nonceIssued(nonce)
+	if !ok {
+		return username, errors.New("unknown digest nonce")
+	}
+	count, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || len(params["nc"]) != 8 {
+		return username, errors.New("malformed nonce count")
+	}
+	ha1, known := table[username]
+	if !known {
+		// compute the response anyway, so that timing doesn't reveal which users exist
+		ha1 = a.dummyHA1[algorithm]
+	}
+	newHash := digestAlgorithms[algorithm]
+	ha2 := digestHex(newHash, method+":"+params["uri"])
+	expected := digestHex(newHash, string(ha1)+":"+nonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 || !known {
+		return username, errors.New("invalid credentials")
+	}
+	expires := issued.Add(time.Duration(a.NonceLifetime))
+	if !now.Before(expires) {
+		return username, digestStaleError{}
+	}
+	if !a.useNonce(nonce, count, expires, now) {
+		return username, errors.New("replayed nonce count")
+	}
+	return username, nil
+}
+
+// useNonce records that nonce was used with count, which must be larger than any count it was used with before.
+func (a *DigestAuth) useNonce(nonce string, count uint64, expires, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if use, ok := a.nonceUses[nonce]; ok {
+		if count <= use.count {
+			return false
+		}
+		use.count = count
+		return true
+	}
+	if len(a.nonceUses) >= a.nextSweep {
+		for n, use := range a.nonceUses {
+			if !now.Before(use.expires) {
+				delete(a.nonceUses, n)
+			}
+		}
+		a.nextSweep = 2*len(a.nonceUses) + 64
+	}
+	a.nonceUses[nonce] = &digestNonceUse{count: count, expires: expires}
+	return true
+}
+
+// quoteAuthParam returns s as a quoted-string.
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseAuthParams parses the comma-separated name=value pairs of credentials, where values may be quoted-strings.
+func parseAuthParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if len(s) == 0 {
+			return params, nil
+		}
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, errors.New("malformed auth parameter")
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated quoted-string")
+			}
+			s = s[i+1:]
+		} else {
+			i = strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:i]))
+			s = s[i:]
+		}
+		params[name] = value.String()
+	}
+}
+
+// checkDigestCredentials verifies Digest credentials against the realm they are for.
+func (h Handler) checkDigestCredentials(r *http.Request, credentials string) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	params, err := parseAuthParams(credentials)
+	if err != nil {
+		repl.Set("http.auth.user.id", "invalidformat:"+err.Error())
+		return err
+	}
+	for _, realm := range h.DigestAuth {
+		if realm.Realm != params["realm"] {
+			continue
+		}
+		user, err := realm.verify(params, r.Method, r.RequestURI, time.Now())
+		if err != nil {
+			repl.Set("http.auth.user.id", "invalid:"+user)
+			return err
+		}
+		repl.Set("http.auth.user.id", user)
+		return nil
+	}
+	repl.Set("http.auth.user.id", "invalid:"+params["username"])
+	return errors.New("unknown digest realm")
+}
@@ -0,0 +1,65 @@
+package forwardproxy
+
+import (
+	"os"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// fileStamp identifies a version of a file, to tell whether it has to be loaded again.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(paths []string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// watchFiles calls reload every time one of paths is modified, until ctx is done.
+// Files are polled every interval. Failed reloads are logged, and are retried on the next modification.
+func watchFiles(ctx caddy.Context, logger *zap.Logger, paths []string, interval time.Duration, reload func() error) {
+	stamps, err := statFiles(paths)
+	if err != nil {
+		logger.Error("failed to stat watched files", zap.Strings("paths", paths), zap.Error(err))
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := statFiles(paths)
+			if err != nil {
+				logger.Error("failed to stat watched files", zap.Strings("paths", paths), zap.Error(err))
+				continue
+			}
+			changed := len(stamps) != len(current)
+			for i := 0; !changed && i < len(current); i++ {
+				changed = !stamps[i].modTime.Equal(current[i].modTime) || stamps[i].size != current[i].size
+			}
+			if !changed {
+				continue
+			}
+			stamps = current
+			if err = reload(); err != nil {
+				logger.Error("failed to reload modified files", zap.Strings("paths", paths), zap.Error(err))
+			} else {
+				logger.Info("reloaded modified files", zap.Strings("paths", paths))
+			}
+		}
+	}()
+}
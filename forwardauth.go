@@ -0,0 +1,179 @@
+package forwardproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// ForwardAuth delegates authentication of proxy clients to an external HTTP service.
+// For every client it has no cached decision about, a GET request is sent to URL with:
+//   - Proxy-Authorization: as sent by the client, if any
+//   - X-Forwarded-For: the IP address of the client
+//   - X-Forwarded-Method: the method of the proxy request (e.g. CONNECT)
+//   - X-Forwarded-Host: the host:port the client wants to reach
+//
+// It is only asked about proxy requests, and requests with Proxy-Authorization.
+//
+// A 2xx response allows the request, as the user in UserHeader. 401 and 403 responses deny it,
+// and anything else (including a 2xx response without UserHeader, or no response at all) is an error,
+// which denies the request without being cached.
+type ForwardAuth struct {
+	URL string `json:"url,omitempty"`
+
+	// Response header with the username of the authenticated client. Default: Remote-User.
+	UserHeader string `json:"user_header,omitempty"`
+
+	// How long decisions are remembered for the same credentials, client IP and target. Default: 0 (no caching).
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+
+	// Timeout of requests to the service. Default: 5s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+	cache  forwardAuthCache
+}
+
+func (f *ForwardAuth) provision() error {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		return fmt.Errorf("expected an http or https URL, got: %s", f.URL)
+	}
+	if len(f.UserHeader) == 0 {
+		f.UserHeader = "Remote-User"
+	}
+	if f.Timeout == 0 {
+		f.Timeout = caddy.Duration(5 * time.Second)
+	}
+	f.client = &http.Client{
+		Timeout: time.Duration(f.Timeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // a redirect to a login page is not an answer
+		},
+	}
+	f.cache.entries = make(map[[sha256.Size]byte]forwardAuthDecision)
+	return nil
+}
+
+// forwardAuthError reports that the service could not decide about a client, which says nothing about its credentials.
+type forwardAuthError struct {
+	err error
+}
+
+func (e forwardAuthError) Error() string {
+	return "auth_url request failed: " + e.err.Error()
+}
+
+func (e forwardAuthError) Unwrap() error {
+	return e.err
+}
+
+// forwardAuthDecision is what the service answered about a client.
+type forwardAuthDecision struct {
+	allowed bool
+	user    string
+	expires time.Time
+}
+
+// check asks the service (or the cache) whether r may be proxied.
+func (f *ForwardAuth) check(r *http.Request) (forwardAuthDecision, error) {
+	clientIP := remoteIP(r)
+	target := proxyRequestTarget(r)
+	authorization := r.Header.Get("Proxy-Authorization")
+	key := sha256.Sum256([]byte(authorization + "\x00" + clientIP + "\x00" + r.Method + "\x00" + target))
+	now := time.Now()
+	if decision, ok := f.cache.get(key, now); ok {
+		return decision, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(f.Timeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return forwardAuthDecision{}, err
+	}
+	if len(authorization) > 0 {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Host", target)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return forwardAuthDecision{}, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // allow reusing the connection
+	resp.Body.Close()
+
+	var decision forwardAuthDecision
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		decision = forwardAuthDecision{allowed: true, user: resp.Header.Get(f.UserHeader)}
+		if len(decision.user) == 0 {
+			return forwardAuthDecision{}, fmt.Errorf("auth_url allowed the request without a %s header", f.UserHeader)
+		}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+	default:
+		return forwardAuthDecision{}, fmt.Errorf("unexpected response status from auth_url: %s", resp.Status)
+	}
+	if f.CacheTTL > 0 {
+		decision.expires = now.Add(time.Duration(f.CacheTTL))
+		f.cache.put(key, decision, now)
+	}
+	return decision, nil
+}
+
+// proxyRequestTarget returns the host:port that a proxy request is for.
+func proxyRequestTarget(r *http.Request) string {
+	hostPort := r.URL.Host
+	if hostPort == "" {
+		hostPort = r.Host
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err == nil || r.Method == http.MethodConnect {
+		return hostPort
+	}
+	if r.URL.Scheme == "https" {
+		return net.JoinHostPort(hostPort, "443")
+	}
+	return net.JoinHostPort(hostPort, "80")
+}
+
+// forwardAuthCache remembers decisions until they expire. Expired entries are swept whenever the cache
+// has doubled in size since the last sweep.
+type forwardAuthCache struct {
+	mu        sync.Mutex
+	entries   map[[sha256.Size]byte]forwardAuthDecision
+	nextSweep int
+}
+
+func (c *forwardAuthCache) get(key [sha256.Size]byte, now time.Time) (forwardAuthDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decision, ok := c.entries[key]
+	return decision, ok && now.Before(decision.expires)
+}
+
+func (c *forwardAuthCache) put(key [sha256.Size]byte, decision forwardAuthDecision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.nextSweep {
+		for k, d := range c.entries {
+			if !now.Before(d.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = 2*len(c.entries) + 64
+	}
+	c.entries[key] = decision
+}
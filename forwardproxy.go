@@ -21,8 +21,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
-	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -30,13 +30,13 @@ import (
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
 	"go.uber.org/zap"
-	"golang.org/x/net/proxy"
 	"golang.org/x/sync/errgroup"
 	"io"
+	mathrand "math/rand"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -61,6 +61,9 @@ type Handler struct {
 	// Filename of the PAC file to serve.
 	PACPath string `json:"pac_path,omitempty"`
 
+	// What the PAC file says. Default: everything but localhost goes through the proxy.
+	PAC *PACConfig `json:"pac,omitempty"`
+
 	// If true, the Forwarded header will not be augmented with your IP address.
 	HideIP bool `json:"hide_ip,omitempty"`
 
@@ -80,6 +83,21 @@ type Handler struct {
 	// Optionally configure an upstream proxy to use.
 	Upstream string `json:"upstream,omitempty"`
 
+	// Optionally configure several upstream proxies to balance between, instead of Upstream.
+	UpstreamPool *UpstreamPool `json:"upstream_pool,omitempty"`
+
+	// Named upstream pools, for Routes.
+	UpstreamPools map[string]*UpstreamPool `json:"upstream_pools,omitempty"`
+
+	// Rules choosing, in order, how to reach destinations: through one of UpstreamPools, or directly.
+	// Destinations that no rule matches go through Upstream or UpstreamPool, if set, or directly.
+	Routes []RouteRule `json:"routes,omitempty"`
+
+	// How ACL is enforced for destinations dialed through the upstream proxy: "hostname" (default) only
+	// evaluates hostname rules against the requested host (or all rules, if it is an IP address), while "resolve"
+	// also resolves the host locally and requires all of its IP addresses to be allowed.
+	UpstreamACL string `json:"upstream_acl,omitempty"`
+
 	// Access control list.
 	ACL []ACLRule `json:"acl,omitempty"`
 
@@ -91,16 +109,84 @@ type Handler struct {
 
 	HostOverride map[string]string `json:"host_override,omitempty"`
 
+	// If true, the first bytes sent through CONNECT tunnels are inspected for the hostname the client
+	// actually talks to (TLS SNI or HTTP Host), and the tunnel is closed if the ACL denies that hostname.
+	InspectTunnel bool `json:"inspect_tunnel,omitempty"`
+
+	// Files mapping domains to categories for `category:` ACL subjects, with one `domain,category`
+	// entry per line. They are reloaded when modified.
+	CategoryDatabases []string `json:"category_databases,omitempty"`
+
+	// MaxMind DB (mmdb) files with countries and/or autonomous systems of IP addresses,
+	// for `country:` and `asn:` ACL subjects. They are reloaded when modified.
+	GeoIPDatabases []string `json:"geoip_databases,omitempty"`
+
+	// How often category and GeoIP databases, and htpasswd files are checked for modifications. Default: 1m.
+	DatabaseReloadInterval caddy.Duration `json:"database_reload_interval,omitempty"`
+
+	// If true, authenticated clients whose request is denied by the ACL are told which rule
+	// denied it in the Proxy-ACL-Rule response header.
+	ACLDebugHeader bool `json:"acl_debug_header,omitempty"`
+
 	// httpTransport *http.Transport
 
-	// overridden dialContext allows us to redirect requests to upstream proxy
+	// dialContext dials destinations directly
 	dialContext func(ctx context.Context, network, address string, bind net.Addr) (net.Conn, error)
-	upstream    *url.URL // address of upstream proxy
+	upstreams   *upstreamPool // default upstream proxies, if any
 
 	aclRules []aclRule
 
-	// TODO: temporary/deprecated - we should try to reuse existing authentication modules instead!
+	// temporary/deprecated - prefer AuthUsers or existing authentication modules (AuthenticationRaw) instead!
 	AuthCredentials [][]byte `json:"auth_credentials,omitempty"` // slice with base64-encoded credentials
+
+	// Users with hashed passwords, accepted in addition to AuthCredentials.
+	AuthUsers []AuthUser `json:"auth_users,omitempty"`
+
+	// Apache htpasswd files with more users, supporting bcrypt, SHA1 and APR1 entries.
+	// They are reloaded when modified.
+	AuthFiles []string `json:"auth_files,omitempty"`
+
+	// How many verified username and password pairs of AuthUsers and AuthFiles to remember, so that their hashes
+	// don't have to be computed on every request. Default: 0 (no caching).
+	AuthCacheSize int `json:"auth_cache_size,omitempty"`
+
+	// Authentication providers (any http.authentication.providers module, e.g. http_basic), which are
+	// given the credentials in Proxy-Authorization as if they were sent in Authorization.
+	AuthenticationRaw caddy.ModuleMap `json:"authentication,omitempty" caddy:"namespace=http.authentication.providers"`
+
+	// Accept signed tokens sent as `Proxy-Authorization: Bearer <token>`.
+	BearerAuth *BearerAuth `json:"bearer_auth,omitempty"`
+
+	// Accept clients that presented a TLS client certificate verified by the server, without Proxy-Authorization.
+	ClientCertAuth *ClientCertAuth `json:"client_cert_auth,omitempty"`
+
+	// Ask an external HTTP service about clients that could not be authenticated otherwise.
+	ForwardAuth *ForwardAuth `json:"forward_auth,omitempty"`
+
+	// Accept Digest credentials, in one or more realms.
+	DigestAuth []*DigestAuth `json:"digest_auth,omitempty"`
+
+	// Realm of the Basic and Bearer challenges, and default realm of DigestAuth. Default: Caddy Secure Web Proxy.
+	AuthRealm string `json:"auth_realm,omitempty"`
+
+	// Schemes to challenge clients with, in order: basic, digest and/or bearer.
+	// Default: digest (if DigestAuth is set), then basic (unless only DigestAuth can check passwords).
+	AuthChallenges []string `json:"auth_challenges,omitempty"`
+
+	// Replaces the body and headers of 407 Proxy Authentication Required responses.
+	AuthRequiredResponse *AuthRequiredResponse `json:"auth_required_response,omitempty"`
+
+	// Rate limits of new tunnels and forwarded requests, all of which have to admit a request.
+	RateLimits []*RateLimit `json:"rate_limits,omitempty"`
+
+	// Limits on concurrent tunnels, bandwidth and traffic of each authenticated user.
+	UserQuota *UserQuota `json:"user_quota,omitempty"`
+
+	// Lock out client IPs and usernames after repeated authentication failures.
+	AuthLockout *AuthLockout `json:"auth_lockout,omitempty"`
+
+	passwordHashes *passwordHashes
+	authProviders  map[string]caddyauth.Authenticator
 }
 
 // CaddyModule returns the Caddy module information.
@@ -120,15 +206,40 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	}
 
 	// access control lists
+	var dbs aclDatabases
+	if h.DatabaseReloadInterval <= 0 {
+		h.DatabaseReloadInterval = caddy.Duration(time.Minute)
+	}
+	if len(h.CategoryDatabases) > 0 {
+		db, err := newCategoryDB(h.CategoryDatabases)
+		if err != nil {
+			return fmt.Errorf("failed to load category databases: %v", err)
+		}
+		watchFiles(ctx, h.logger, h.CategoryDatabases, time.Duration(h.DatabaseReloadInterval), db.reload)
+		dbs.categories = db
+	}
+	if len(h.GeoIPDatabases) > 0 {
+		db, err := newGeoIPDB(h.GeoIPDatabases)
+		if err != nil {
+			return fmt.Errorf("failed to load GeoIP databases: %v", err)
+		}
+		watchFiles(ctx, h.logger, h.GeoIPDatabases, time.Duration(h.DatabaseReloadInterval), db.reload)
+		dbs.geoIP = db
+	}
 	for _, rule := range h.ACL {
-		for _, subj := range rule.Subjects {
-			ar, err := newACLRule(subj, rule.Allow)
+		for i, subj := range rule.Subjects {
+			var source string
+			if i < len(rule.Sources) {
+				source = rule.Sources[i]
+			}
+			ar, err := newACLRule(subj, source, rule.Allow, dbs)
 			if err != nil {
 				return err
 			}
 			h.aclRules = append(h.aclRules, ar)
 		}
 	}
+	userRules := len(h.aclRules) // the PAC file leaves the default policy to the proxy
 	for _, ipDeny := range []string{
 		"10.0.0.0/8",
 		"127.0.0.0/8",
@@ -137,21 +248,137 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		"::1/128",
 		"fe80::/10",
 	} {
-		ar, err := newACLRule(ipDeny, false)
+		ar, err := newACLRule(ipDeny, "default policy", false, dbs)
 		if err != nil {
 			return err
 		}
 		h.aclRules = append(h.aclRules, ar)
 	}
-	h.aclRules = append(h.aclRules, &aclAllRule{allow: true})
+	ar, _ := newACLRule("all", "default policy", true, dbs)
+	h.aclRules = append(h.aclRules, ar)
+
+	if len(h.PACPath) > 0 || h.PAC != nil && (len(h.PAC.UserPath) > 0 || len(h.PAC.WPADHosts) > 0) {
+		if h.PAC == nil {
+			h.PAC = &PACConfig{}
+		}
+		if err := h.PAC.provision(ctx, h.aclRules[:userRules]); err != nil {
+			return fmt.Errorf("bad pac: %v", err)
+		}
+		if len(h.PAC.WPADHosts) > 0 && h.ProbeResistance != nil {
+			return errors.New("wpad_hosts cannot be used with probe_resistance, as they give the proxy away")
+		}
+	} else if h.PAC != nil {
+		return errors.New("pac requires pac_path, user_path or wpad_hosts")
+	}
+
+	if len(h.AuthUsers) > 0 || len(h.AuthFiles) > 0 {
+		var err error
+		if h.passwordHashes, err = newPasswordHashes(h.AuthUsers, h.AuthFiles, h.AuthCacheSize); err != nil {
+			return fmt.Errorf("bad auth_users or auth_files: %v", err)
+		}
+		if len(h.AuthFiles) > 0 {
+			reload := h.passwordHashes.reload
+			if h.PAC != nil && len(h.PAC.UserPath) > 0 {
+				reload = func() error {
+					if err := h.passwordHashes.reload(); err != nil {
+						return err
+					}
+					h.PAC.loadUsers(h.pacUsers())
+					return nil
+				}
+			}
+			watchFiles(ctx, h.logger, h.AuthFiles, time.Duration(h.DatabaseReloadInterval), reload)
+		}
+	}
+	if h.PAC != nil && len(h.PAC.UserPath) > 0 {
+		h.PAC.loadUsers(h.pacUsers())
+	}
+
+	if h.AuthenticationRaw != nil {
+		mods, err := ctx.LoadModule(h, "AuthenticationRaw")
+		if err != nil {
+			return fmt.Errorf("loading authentication providers: %v", err)
+		}
+		h.authProviders = make(map[string]caddyauth.Authenticator)
+		for modName, modIface := range mods.(map[string]any) {
+			h.authProviders[modName] = modIface.(caddyauth.Authenticator)
+		}
+	}
+
+	if h.BearerAuth != nil {
+		if err := h.BearerAuth.provision(); err != nil {
+			return fmt.Errorf("bad bearer_auth: %v", err)
+		}
+	}
+
+	if h.ClientCertAuth != nil {
+		if err := h.ClientCertAuth.provision(); err != nil {
+			return fmt.Errorf("bad client_cert_auth: %v", err)
+		}
+	}
+
+	if h.ForwardAuth != nil {
+		if err := h.ForwardAuth.provision(); err != nil {
+			return fmt.Errorf("bad auth_url: %v", err)
+		}
+	}
+
+	if len(h.AuthRealm) == 0 {
+		h.AuthRealm = defaultRealm
+	}
+	realms := make(map[string]bool)
+	for _, realm := range h.DigestAuth {
+		if err := realm.provision(h.AuthRealm, h.AuthCredentials); err != nil {
+			return fmt.Errorf("bad digest_auth: %v", err)
+		}
+		if realms[realm.Realm] {
+			return fmt.Errorf("digest_auth realm %s is configured more than once", realm.Realm)
+		}
+		realms[realm.Realm] = true
+	}
+
+	if err := h.validateAuthChallenges(); err != nil {
+		return fmt.Errorf("bad auth_challenges: %v", err)
+	}
+	if h.AuthRequiredResponse != nil {
+		if err := h.AuthRequiredResponse.provision(); err != nil {
+			return fmt.Errorf("bad auth_required_response: %v", err)
+		}
+	}
+
+	for _, limit := range h.RateLimits {
+		if err := limit.provision(); err != nil {
+			return fmt.Errorf("bad rate_limit: %v", err)
+		}
+	}
+
+	if h.UserQuota != nil {
+		if err := h.UserQuota.provision(ctx, h.logger); err != nil {
+			return fmt.Errorf("bad user_quota: %v", err)
+		}
+	}
+
+	if h.AuthLockout != nil {
+		if err := h.AuthLockout.provision(); err != nil {
+			return fmt.Errorf("bad auth_lockout: %v", err)
+		}
+	}
 
 	if h.ProbeResistance != nil {
-		if h.AuthCredentials == nil {
+		if !h.authEnabled() {
 			return fmt.Errorf("probe resistance requires authentication")
 		}
 		if len(h.ProbeResistance.Domain) > 0 {
 			h.logger.Info("Secret domain used to connect to proxy: " + h.ProbeResistance.Domain)
 		}
+		if h.ProbeResistance.Page != nil {
+			if err := h.ProbeResistance.Page.provision(); err != nil {
+				return fmt.Errorf("bad probe_resistance page: %v", err)
+			}
+		}
+		if err := h.ProbeResistance.provisionKnocks(); err != nil {
+			return fmt.Errorf("bad probe_resistance knocks: %v", err)
+		}
 	}
 
 	dialer := &net.Dialer{
@@ -168,58 +395,40 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		return d.DialContext(ctx, bind.Network(), address)
 	}
 
+	switch h.UpstreamACL {
+	case "", upstreamACLHostname, upstreamACLResolve:
+	default:
+		return fmt.Errorf("unknown upstream_acl mode: %s", h.UpstreamACL)
+	}
+
+	if h.Upstream != "" && h.UpstreamPool != nil {
+		return errors.New("upstream and upstream_pool cannot be used together")
+	}
+	pool := h.UpstreamPool
 	if h.Upstream != "" {
-		upstreamURL, err := url.Parse(h.Upstream)
+		pool = &UpstreamPool{URLs: []string{h.Upstream}}
+	}
+	if pool != nil {
+		upstreams, err := newUpstreamPool(ctx, pool, dialer, h.logger)
 		if err != nil {
-			return fmt.Errorf("bad upstream URL: %v", err)
-		}
-		h.upstream = upstreamURL
-
-		if !isLocalhost(h.upstream.Hostname()) && h.upstream.Scheme != "https" {
-			return errors.New("insecure schemes are only allowed to localhost upstreams")
+			return err
 		}
-
-		registerHTTPDialer := func(u *url.URL, _ proxy.Dialer) (proxy.Dialer, error) {
-			// CONNECT request is proxied as-is, so we don't care about target url, but it could be
-			// useful in future to implement policies of choosing between multiple upstream servers.
-			// Given dialer is not used, since it's the same dialer provided by us.
-			d, err := httpclient.NewHTTPConnectDialer(h.upstream.String())
-			if err != nil {
-				return nil, err
-			}
-			d.Dialer = *dialer
-			if isLocalhost(h.upstream.Hostname()) && h.upstream.Scheme == "https" {
-				// disabling verification helps with testing the package and setups
-				// either way, it's impossible to have a legit TLS certificate for "127.0.0.1" - TODO: not true anymore
-				h.logger.Info("Localhost upstream detected, disabling verification of TLS certificate")
-				d.DialTLS = func(network string, address string) (net.Conn, string, error) {
-					conn, err := tls.Dial(network, address, &tls.Config{InsecureSkipVerify: true}) // #nosec G402
-					if err != nil {
-						return nil, "", err
-					}
-					return conn, conn.ConnectionState().NegotiatedProtocol, nil
-				}
-			}
-			return d, nil
+		h.upstreams = upstreams
+	}
+	pools := make(map[string]*upstreamPool, len(h.UpstreamPools))
+	for name, pool := range h.UpstreamPools {
+		if name == routeDirect {
+			return fmt.Errorf("upstream pools cannot be named %s", routeDirect)
 		}
-		proxy.RegisterDialerType("https", registerHTTPDialer)
-		proxy.RegisterDialerType("http", registerHTTPDialer)
-
-		upstreamDialer, err := proxy.FromURL(h.upstream, dialer)
+		upstreams, err := newUpstreamPool(ctx, pool, dialer, h.logger)
 		if err != nil {
-			return errors.New("failed to create proxy to upstream: " + err.Error())
+			return fmt.Errorf("bad upstream pool %s: %v", name, err)
 		}
-
-		if ctxDialer, ok := upstreamDialer.(dialContexter); ok {
-			// upstreamDialer has DialContext - use it
-			h.dialContext = func(ctx context.Context, network string, address string, bind net.Addr) (net.Conn, error) {
-				return ctxDialer.DialContext(ctx, network, address)
-			}
-		} else {
-			// upstreamDialer does not have DialContext - ignore the context :(
-			h.dialContext = func(ctx context.Context, network string, address string, bind net.Addr) (net.Conn, error) {
-				return upstreamDialer.Dial(network, address)
-			}
+		pools[name] = upstreams
+	}
+	for i := range h.Routes {
+		if err := h.Routes[i].provision(pools, dbs); err != nil {
+			return fmt.Errorf("bad route: %v", err)
 		}
 	}
 
@@ -233,12 +442,29 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		reqHost = r.Host // OK; probably just didn't have a port
 	}
 
+	var start time.Time // for equalizing the timing with probe resistance
+	var unlocked bool   // the client knocked to unlock the proxy, before this request
+	if h.ProbeResistance != nil {
+		start = h.ProbeResistance.now()
+	}
+	if h.ProbeResistance != nil && len(h.ProbeResistance.KnockPaths) > 0 {
+		clientIP, now := remoteIP(r), time.Now()
+		unlocked = h.ProbeResistance.unlocked(clientIP, now)
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && len(r.URL.Host) == 0 { // not proxy requests
+			h.ProbeResistance.knock(clientIP, r.URL.Path, now)
+		}
+	}
+
 	var authErr error
-	if h.AuthCredentials != nil {
-		authErr = h.checkCredentials(r)
+	if h.authEnabled() {
+		authErr = h.authenticate(r)
 	}
 	if h.ProbeResistance != nil && len(h.ProbeResistance.Domain) > 0 && reqHost == h.ProbeResistance.Domain {
-		return serveHiddenPage(w, authErr)
+		h.ProbeResistance.equalizeTiming(r, start)
+		return h.serveHiddenPage(w, r, authErr)
+	}
+	if h.shouldServeWPAD(r) {
+		return h.servePacFile(w, r)
 	}
 	if h.Hosts.Match(r) && (r.Method != http.MethodConnect || authErr != nil) {
 		// Always pass non-CONNECT requests to hostname
@@ -246,16 +472,24 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		if h.shouldServePACFile(r) {
 			return h.servePacFile(w, r)
 		}
+		if h.ProbeResistance != nil {
+			h.ProbeResistance.equalizeTiming(r, start)
+		}
 		return next.ServeHTTP(w, r)
 	}
 	if authErr != nil {
-		if h.ProbeResistance != nil {
+		if h.ProbeResistance != nil && !unlocked {
 			// probe resistance is requested and requested URI does not match secret domain;
 			// act like this proxy handler doesn't even exist (pass thru to next handler)
+			h.ProbeResistance.equalizeTiming(r, start)
 			return next.ServeHTTP(w, r)
 		}
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Caddy Secure Web Proxy\"")
-		return caddyhttp.Error(http.StatusProxyAuthRequired, authErr)
+		var lockedOut *lockedOutError
+		if errors.As(authErr, &lockedOut) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedOut.until).Seconds())+1))
+			return caddyhttp.Error(http.StatusTooManyRequests, authErr)
+		}
+		return h.writeAuthRequired(w, r, authErr, "")
 	}
 
 	if r.ProtoMajor != 1 && r.ProtoMajor != 2 && r.ProtoMajor != 3 {
@@ -263,6 +497,27 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			fmt.Errorf("unsupported HTTP major version: %d", r.ProtoMajor))
 	}
 
+	if err := h.checkRateLimits(r); err != nil {
+		if h.ProbeResistance != nil {
+			h.ProbeResistance.equalizeTiming(r, start)
+			return next.ServeHTTP(w, r)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(err.(*rateLimitedError).retryAfter.Seconds())+1))
+		return caddyhttp.Error(http.StatusTooManyRequests, err)
+	}
+
+	quotaUser := h.quotaUser(r)
+	if len(quotaUser) > 0 {
+		release, err := h.UserQuota.acquire(quotaUser, r.Method == http.MethodConnect, time.Now())
+		if err != nil {
+			if retryAfter := err.(*quotaExceededError).retryAfter; retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			}
+			return caddyhttp.Error(http.StatusTooManyRequests, err)
+		}
+		defer release()
+	}
+
 	ctx := context.Background()
 	if !h.HideIP {
 		ctxHeader := make(http.Header)
@@ -274,6 +529,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		ctxHeader.Add("Forwarded", "for=\""+r.RemoteAddr+"\"")
 		ctx = context.WithValue(ctx, httpclient.ContextKeyHeader{}, ctxHeader)
 	}
+	if h.authEnabled() {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		user, _ := repl.GetString("http.auth.user.id")
+		ctx = context.WithValue(ctx, upstreamUserKey{}, user)
+	}
 
 	clientBind := r.Header.Get("Proxy-Nonlocal-Source")
 	var bind net.Addr
@@ -285,6 +545,9 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 	}
 
+	if h.ProbeResistance != nil && r.Method != http.MethodConnect {
+		h.ProbeResistance.equalizeTiming(r, start)
+	}
 	if r.Method == http.MethodConnect {
 		if r.ProtoMajor == 2 || r.ProtoMajor == 3 {
 			if len(r.URL.Scheme) > 0 || len(r.URL.Path) > 0 {
@@ -297,8 +560,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		if hostPort == "" {
 			hostPort = r.Host
 		}
-		targetConn, err := h.dialContextCheckACL(ctx, "tcp", hostPort, bind)
+		targetConn, upstreams, err := h.dialContextRoute(ctx, "tcp", hostPort, bind)
+		if h.ProbeResistance != nil {
+			// the dial is padded too, as failed attempts would not dial at all
+			h.ProbeResistance.equalizeTiming(r, start)
+		}
 		if err != nil {
+			h.setACLDebugHeader(w, err)
 			return err
 		}
 		if targetConn == nil {
@@ -308,10 +576,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 				fmt.Errorf("hostname %s is not allowed", r.URL.Hostname()))
 		}
 		defer targetConn.Close()
+		if len(quotaUser) > 0 {
+			targetConn = quotaConn{Conn: targetConn, ctx: r.Context(), quota: h.UserQuota, user: quotaUser}
+		}
+
+		var inspect func(client io.Reader, prefix []byte) (int64, error)
+		if h.InspectTunnel {
+			inspect = func(client io.Reader, prefix []byte) (int64, error) {
+				return h.inspectTunnel(ctx, targetConn, upstreams, client, prefix)
+			}
+		}
 
 		switch r.ProtoMajor {
 		case 1: // http1: hijack the whole flow
-			return h.serveHijack(ctx, r.Body, w, targetConn)
+			return h.serveHijack(ctx, r.Body, w, targetConn, inspect)
 		case 2: // http2: keep reading from "request" and writing into same response
 			fallthrough
 		case 3:
@@ -323,7 +601,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			}
 			w.WriteHeader(http.StatusOK)
 			wFlusher.Flush()
-			_, _, err := dualStream(ctx, targetConn, r.Body, w)
+			_, _, err := dualStream(ctx, targetConn, r.Body, w, nil, inspect)
 			return err
 		}
 
@@ -345,6 +623,9 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	r.RequestURI = ""
 
 	removeHopByHop(r.Header)
+	if len(quotaUser) > 0 {
+		r.Body = quotaReadCloser{ReadCloser: r.Body, ctx: r.Context(), quota: h.UserQuota, user: quotaUser}
+	}
 
 	if !h.HideIP {
 		r.Header.Add("Forwarded", "for=\""+r.RemoteAddr+"\"")
@@ -355,9 +636,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		r.Header.Add("Via", strconv.Itoa(r.ProtoMajor)+"."+strconv.Itoa(r.ProtoMinor)+" caddy")
 	}
 
+	port := r.URL.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
 	var response *http.Response
-	if h.upstream == nil {
-		// non-upstream request uses httpTransport to reuse connections
+	if h.route(ctx, r.URL.Hostname(), port, bind) == nil {
+		// non-upstream request (including direct routes) uses httpTransport to reuse connections
 		if r.Body != nil &&
 			(r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" || r.Method == "TRACE") {
 			// make sure request is idempotent and could be retried by saving the Body
@@ -385,19 +670,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		// Upstream requests don't interact well with Transport: connections could always be
 		// reused, but Transport thinks they go to different Hosts, so it spawns tons of
 		// useless connections.
-		// Just use dialContext, which will multiplex via single connection, if http/2
-		if creds := h.upstream.User.String(); creds != "" {
-			// set upstream credentials for the request, if needed
-			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
-		}
+		// Just use dialContext, which will multiplex via single connection, if http/2.
+		// The request goes through a CONNECT tunnel, so upstream credentials are sent with the CONNECT request
+		// (and must not be sent along to the destination).
 		if r.URL.Port() == "" {
 			r.URL.Host = net.JoinHostPort(r.URL.Host, "80")
 		}
-		upsConn, err := h.dialContext(ctx, "tcp", r.URL.Host, bind)
-		if err != nil {
-			return caddyhttp.Error(http.StatusBadGateway,
-				fmt.Errorf("failed to dial upstream: %v", err))
+		var upsConn net.Conn
+		if upsConn, err = h.dialContextCheckACL(ctx, "tcp", r.URL.Host, bind); err != nil {
+			h.setACLDebugHeader(w, err)
+			return err
 		}
+		defer upsConn.Close()
 		err = r.Write(upsConn)
 		if err != nil {
 			return caddyhttp.Error(http.StatusBadGateway,
@@ -420,16 +704,120 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	if err != nil {
 		// fmt.Printf("%v", err)
 		if _, ok := err.(caddyhttp.HandlerError); ok {
+			h.setACLDebugHeader(w, err)
 			return err
 		}
 		return caddyhttp.Error(http.StatusBadGateway,
 			fmt.Errorf("failed to read response: %v", err))
 	}
 
+	if len(quotaUser) > 0 {
+		response.Body = quotaReadCloser{ReadCloser: response.Body, ctx: r.Context(), quota: h.UserQuota, user: quotaUser}
+	}
 	return forwardResponse(w, response)
 }
 
+// authEnabled reports whether clients have to authenticate to use the proxy.
+func (h Handler) authEnabled() bool {
+	return h.AuthCredentials != nil || h.passwordHashes != nil || h.authProviders != nil || h.BearerAuth != nil ||
+		h.ClientCertAuth != nil || h.ForwardAuth != nil || len(h.DigestAuth) > 0
+}
+
+// checkCredentials authenticates the client, and sets http.auth.user.id to who it is (or claims to be).
 func (h Handler) checkCredentials(r *http.Request) error {
+	if h.ClientCertAuth != nil && r.TLS != nil {
+		if user := h.ClientCertAuth.username(r.TLS.VerifiedChains); len(user) > 0 {
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			repl.Set("http.auth.user.id", user)
+			return nil
+		}
+	}
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if h.BearerAuth != nil && strings.EqualFold(scheme, "bearer") {
+		return h.checkBearerCredentials(r, credentials)
+	}
+	if len(h.DigestAuth) > 0 && strings.EqualFold(scheme, "digest") {
+		return h.checkDigestCredentials(r, credentials)
+	}
+	err := h.checkBasicCredentials(r)
+	if err != nil && h.authProviders != nil && h.checkAuthProviders(r) {
+		return nil
+	}
+	if err != nil && h.ForwardAuth != nil && (isProxyRequest(r) || len(r.Header.Get("Proxy-Authorization")) > 0) {
+		// not for every request to the site, which would flood the service
+		return h.checkForwardAuth(r)
+	}
+	return err
+}
+
+// isProxyRequest reports whether r asks to be proxied (CONNECT, or an absolute URL), rather than for the site itself.
+func isProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || len(r.URL.Host) > 0
+}
+
+// checkForwardAuth lets the auth_url service decide whether the client is authenticated.
+func (h Handler) checkForwardAuth(r *http.Request) error {
+	decision, err := h.ForwardAuth.check(r)
+	if err != nil {
+		h.logger.Error("auth_url request failed", zap.Error(err))
+		return forwardAuthError{err}
+	}
+	if !decision.allowed {
+		return errors.New("denied by auth_url")
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("http.auth.user.id", decision.user)
+	return nil
+}
+
+// checkAuthProviders runs the authentication providers against Proxy-Authorization.
+func (h Handler) checkAuthProviders(r *http.Request) bool {
+	providerReq := new(http.Request)
+	*providerReq = *r
+	providerReq.Header = r.Header.Clone()
+	providerReq.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	// providers may challenge the client by setting headers, which is up to us instead
+	w := discardResponseWriter{header: make(http.Header)}
+	for provName, prov := range h.authProviders {
+		user, authed, err := prov.Authenticate(w, providerReq)
+		if err != nil {
+			h.logger.Error("auth provider returned error", zap.String("provider", provName), zap.Error(err))
+			continue
+		}
+		if authed {
+			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			repl.Set("http.auth.user.id", user.ID)
+			for k, v := range user.Metadata {
+				repl.Set("http.auth.user."+k, v)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// checkBearerCredentials verifies a token sent as Bearer credentials.
+func (h Handler) checkBearerCredentials(r *http.Request, token string) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	user, err := h.BearerAuth.verify(token, time.Now())
+	if err != nil {
+		repl.Set("http.auth.user.id", "invalidtoken:"+err.Error())
+		return err
+	}
+	repl.Set("http.auth.user.id", user)
+	return nil
+}
+
+// discardResponseWriter is given to code that must not respond to the client.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
+func (h Handler) checkBasicCredentials(r *http.Request) error {
 	pa := strings.Split(r.Header.Get("Proxy-Authorization"), " ")
 	if len(pa) != 2 {
 		return errors.New("Proxy-Authorization is required! Expected format: <type> <credentials>")
@@ -437,20 +825,22 @@ func (h Handler) checkCredentials(r *http.Request) error {
 	if strings.ToLower(pa[0]) != "basic" {
 		return errors.New("auth type is not supported")
 	}
-	for _, creds := range h.AuthCredentials {
-		if subtle.ConstantTimeCompare(creds, []byte(pa[1])) == 1 {
-			repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-			buf := make([]byte, base64.StdEncoding.DecodedLen(len(creds)))
-			_, _ = base64.StdEncoding.Decode(buf, creds) // should not err ever since we are decoding a known good input
-			cred := string(buf)
-			repl.Set("http.auth.user.id", cred[:strings.IndexByte(cred, ':')])
-			// Please do not consider this to be timing-attack-safe code. Simple equality is almost
-			// mindlessly substituted with constant time algo and there ARE known issues with this code,
-			// e.g. size of smallest credentials is guessable. TODO: protect from all the attacks! Hash?
-			return nil
-		}
+	// Compare digests with all credentials, so that timing reveals neither their lengths nor which of them matched.
+	digest := sha256.Sum256([]byte(pa[1]))
+	match := -1
+	for i, creds := range h.AuthCredentials {
+		credsDigest := sha256.Sum256(creds)
+		match = subtle.ConstantTimeSelect(subtle.ConstantTimeCompare(credsDigest[:], digest[:]), i, match)
 	}
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if match >= 0 {
+		creds := h.AuthCredentials[match]
+		buf := make([]byte, base64.StdEncoding.DecodedLen(len(creds)))
+		_, _ = base64.StdEncoding.Decode(buf, creds) // should not err ever since we are decoding a known good input
+		cred := string(buf)
+		repl.Set("http.auth.user.id", cred[:strings.IndexByte(cred, ':')])
+		return nil
+	}
 	buf := make([]byte, base64.StdEncoding.DecodedLen(len([]byte(pa[1]))))
 	n, err := base64.StdEncoding.Decode(buf, []byte(pa[1]))
 	if err != nil {
@@ -460,6 +850,10 @@ func (h Handler) checkCredentials(r *http.Request) error {
 	if utf8.Valid(buf[:n]) {
 		cred := string(buf[:n])
 		i := strings.IndexByte(cred, ':')
+		if i >= 0 && h.passwordHashes != nil && h.passwordHashes.verify(cred[:i], cred[i+1:]) {
+			repl.Set("http.auth.user.id", cred[:i])
+			return nil
+		}
 		if i >= 0 {
 			repl.Set("http.auth.user.id", "invalid:"+cred[:i])
 		} else {
@@ -471,54 +865,93 @@ func (h Handler) checkCredentials(r *http.Request) error {
 	return errors.New("invalid credentials")
 }
 
+// setACLDebugHeader tells an authenticated client which ACL rule denied its request, if enabled.
+func (h Handler) setACLDebugHeader(w http.ResponseWriter, err error) {
+	if !h.ACLDebugHeader || !h.authEnabled() {
+		return
+	}
+	var aclErr *aclDeniedError
+	if errors.As(err, &aclErr) && aclErr.rule != nil {
+		w.Header().Set("Proxy-ACL-Rule", aclErr.rule.String())
+	}
+}
+
 func (h Handler) shouldServePACFile(r *http.Request) bool {
-	return len(h.PACPath) > 0 && r.URL.Path == h.PACPath
+	if len(h.PACPath) > 0 && r.URL.Path == h.PACPath {
+		return true
+	}
+	_, ok := h.pacUser(r.URL.Path)
+	return ok
+}
+
+// shouldServeWPAD reports whether r asks a WPAD host for the PAC file, from the local network.
+func (h Handler) shouldServeWPAD(r *http.Request) bool {
+	if h.PAC == nil || len(h.PAC.WPADHosts) == 0 || r.Method != http.MethodGet && r.Method != http.MethodHead ||
+		r.URL.Path != "/wpad.dat" || !h.PAC.WPADHosts.Match(r) {
+		return false
+	}
+	ip := net.ParseIP(remoteIP(r))
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
 }
 
 func (h Handler) servePacFile(w http.ResponseWriter, r *http.Request) error {
-	fmt.Fprintf(w, pacFile, r.Host)
-	// fmt.Fprintf(w, pacFile, h.hostname, h.port)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if user, ok := h.pacUser(r.URL.Path); ok {
+		repl.Set("http.forward_proxy.pac_user", user)
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = io.WriteString(w, h.PAC.generate(repl))
 	return nil
 }
 
 // dialContextCheckACL enforces Access Control List and calls fp.DialContext
 func (h Handler) dialContextCheckACL(ctx context.Context, network, hostPort string, bind net.Addr) (net.Conn, error) {
+	conn, _, err := h.dialContextRoute(ctx, network, hostPort, bind)
+	return conn, err
+}
+
+// dialContextRoute is dialContextCheckACL, also returning the upstreams that the route goes through, or nil if direct.
+func (h Handler) dialContextRoute(ctx context.Context, network, hostPort string, bind net.Addr) (net.Conn, *upstreamPool, error) {
 	var conn net.Conn
 
 	if network != "tcp" && network != "tcp4" && network != "tcp6" {
 		// return nil, &proxyError{S: "Network " + network + " is not supported", Code: http.StatusBadRequest}
-		return nil, caddyhttp.Error(http.StatusBadRequest,
+		return nil, nil, caddyhttp.Error(http.StatusBadRequest,
 			fmt.Errorf("network %s is not supported", network))
 	}
 
 	host, port, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		// return nil, &proxyError{S: err.Error(), Code: http.StatusBadRequest}
-		return nil, caddyhttp.Error(http.StatusBadRequest, err)
-	}
-
-	if h.upstream != nil {
-		// if upstreaming -- do not resolve locally nor check acl
-		conn, err = h.dialContext(ctx, network, hostPort, bind)
-		if err != nil {
-			// return conn, &proxyError{S: err.Error(), Code: http.StatusBadGateway}
-			return conn, caddyhttp.Error(http.StatusBadGateway, err)
-		}
-		return conn, nil
+		return nil, nil, caddyhttp.Error(http.StatusBadRequest, err)
 	}
 
 	if !h.portIsAllowed(port) {
 		// return nil, &proxyError{S: "port " + port + " is not allowed", Code: http.StatusForbidden}
-		return nil, caddyhttp.Error(http.StatusForbidden,
+		return nil, nil, caddyhttp.Error(http.StatusForbidden,
 			fmt.Errorf("port %s is not allowed", port))
 	}
 
+	if upstreams := h.route(ctx, host, port, bind); upstreams != nil {
+		// if upstreaming -- the upstream resolves the host, so only check what we can know locally
+		if err = h.checkUpstreamACL(ctx, host); err != nil {
+			return nil, nil, err
+		}
+		conn, err = upstreams.dialContext(ctx, network, hostPort)
+		if err != nil {
+			// return conn, &proxyError{S: err.Error(), Code: http.StatusBadGateway}
+			return conn, upstreams, caddyhttp.Error(http.StatusBadGateway,
+				fmt.Errorf("failed to dial upstream: %v", err))
+		}
+		return conn, upstreams, nil
+	}
+
 match:
 	for _, rule := range h.aclRules {
-		if _, ok := rule.(*aclDomainRule); ok {
+		if isHostnameRule(rule) {
 			switch rule.tryMatch(nil, host) {
 			case aclDecisionDeny:
-				return nil, caddyhttp.Error(http.StatusForbidden, fmt.Errorf("disallowed host %s", host))
+				return nil, nil, h.aclDenied("disallowed host "+host, host, nil, rule)
 			case aclDecisionAllow:
 				break match
 			}
@@ -536,7 +969,7 @@ match:
 				ones, _ := h.DefaultBind.Mask.Size()
 				_, err := rand.Read(ip[ones>>3:])
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 				bind = &net.TCPAddr{IP: ip}
 			}
@@ -546,42 +979,101 @@ match:
 	if err != nil {
 		// return nil, &proxyError{S: fmt.Sprintf("Lookup of %s failed: %v", host, err),
 		// Code: http.StatusBadGateway}
-		return nil, caddyhttp.Error(http.StatusBadGateway,
+		return nil, nil, caddyhttp.Error(http.StatusBadGateway,
 			fmt.Errorf("lookup of %s failed: %v", host, err))
 	}
 
 	// This is net.Dial's default behavior: if the host resolves to multiple IP addresses,
 	// Dial will try each IP address in order until one succeeds
 	err = nil
+	var deniedIP net.IP
+	var deniedBy aclRule
 	for _, ip := range IPs {
-		if !h.hostIsAllowed(host, ip.IP) {
+		if allowed, rule := h.hostIsAllowed(host, ip.IP); !allowed {
+			if deniedBy == nil {
+				deniedIP, deniedBy = ip.IP, rule
+			}
 			continue
 		}
 
 		conn, err = h.dialContext(ctx, network, net.JoinHostPort(ip.String(), port), bind)
 		if err == nil {
-			return conn, nil
+			return conn, nil, nil
 		}
 	}
 	if err != nil {
-		return nil, caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("dialContext: %v", err))
+		return nil, nil, caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("dialContext: %v", err))
 	}
 
-	return nil, caddyhttp.Error(http.StatusForbidden, fmt.Errorf("no allowed IP addresses for %s", host))
+	return nil, nil, h.aclDenied("no allowed IP addresses for "+host, host, deniedIP, deniedBy)
 }
 
-func (h Handler) hostIsAllowed(hostname string, ip net.IP) bool {
+// checkUpstreamACL enforces the ACL on a host that the upstream proxy is going to resolve and connect to.
+func (h Handler) checkUpstreamACL(ctx context.Context, host string) error {
+	if h.UpstreamACL == upstreamACLResolve {
+		IPs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadGateway,
+				fmt.Errorf("lookup of %s failed: %v", host, err))
+		}
+		// the upstream may pick any of these addresses, so all of them have to be allowed
+		for _, ip := range IPs {
+			if allowed, rule := h.hostIsAllowed(host, ip.IP); !allowed {
+				return h.aclDenied("disallowed IP address "+ip.String()+" for "+host, host, ip.IP, rule)
+			}
+		}
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		// the upstream connects to exactly this address
+		if allowed, rule := h.hostIsAllowed(host, ip); !allowed {
+			return h.aclDenied("disallowed IP address "+host, host, ip, rule)
+		}
+		return nil
+	}
+	for _, rule := range h.aclRules {
+		if _, ok := rule.(*aclIPRule); ok {
+			continue
+		}
+		switch rule.tryMatch(nil, host) {
+		case aclDecisionDeny:
+			return h.aclDenied("disallowed host "+host, host, nil, rule)
+		case aclDecisionAllow:
+			return nil
+		}
+	}
+	return nil
+}
+
+// aclDenied logs an ACL denial along with the rule responsible for it and returns the matching handler error.
+func (h Handler) aclDenied(msg, host string, ip net.IP, rule aclRule) error {
+	if h.logger != nil {
+		fields := []zap.Field{zap.String("host", host)}
+		if ip != nil {
+			fields = append(fields, zap.Stringer("ip", ip))
+		}
+		if rule != nil {
+			fields = append(fields, zap.Stringer("rule", rule))
+		}
+		h.logger.Debug("destination denied by ACL", fields...)
+	}
+	return caddyhttp.Error(http.StatusForbidden, &aclDeniedError{msg: msg, rule: rule})
+}
+
+// hostIsAllowed returns whether the host may be connected to at ip, and the rule that decided it.
+func (h Handler) hostIsAllowed(hostname string, ip net.IP) (bool, aclRule) {
 	for _, rule := range h.aclRules {
 		switch rule.tryMatch(ip, hostname) {
 		case aclDecisionDeny:
-			return false
+			return false, rule
 		case aclDecisionAllow:
-			return true
+			return true, rule
 		}
 	}
-	// TODO: convert this to log entry
-	// fmt.Println("ERROR: no acl match for ", hostname, ip) // shouldn't happen
-	return false
+	if h.logger != nil {
+		h.logger.Error("no ACL rule matched", zap.String("host", hostname), zap.Stringer("ip", ip)) // shouldn't happen
+	}
+	return false, nil
 }
 
 func (h Handler) portIsAllowed(port string) bool {
@@ -605,7 +1097,7 @@ func (h Handler) portIsAllowed(port string) bool {
 	return isAllowed
 }
 
-func serveHiddenPage(w http.ResponseWriter, authErr error) error {
+func (h Handler) serveHiddenPage(w http.ResponseWriter, r *http.Request, authErr error) error {
 	const hiddenPage = `<html>
 <head>
   <title>Hidden Proxy Page</title>
@@ -618,71 +1110,77 @@ func serveHiddenPage(w http.ResponseWriter, authErr error) error {
 	const AuthFail = "Please authenticate yourself to the proxy."
 	const AuthOk = "Congratulations, you are successfully authenticated to the proxy! Go browse all the things!"
 
-	w.Header().Set("Content-Type", "text/html")
 	if authErr != nil {
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Caddy Secure Web Proxy\"")
-		w.WriteHeader(http.StatusProxyAuthRequired)
-		_, _ = w.Write([]byte(fmt.Sprintf(hiddenPage, AuthFail)))
-		return authErr
+		w.Header().Set("Content-Type", "text/html")
+		return h.writeAuthRequired(w, r, authErr, fmt.Sprintf(hiddenPage, AuthFail))
+	}
+	if h.ProbeResistance.Page != nil {
+		h.writeHiddenPage(w, r)
+		return nil
 	}
+	w.Header().Set("Content-Type", "text/html")
 	_, _ = w.Write([]byte(fmt.Sprintf(hiddenPage, AuthOk)))
 	return nil
 }
 
 // Do it in a separate function so that resources/buffer arrays get cleaned up when exit
-func doHijack(w http.ResponseWriter, targetConn net.Conn) (net.Conn, error) {
+// Returns the hijacked connection and data the client has already sent past the request.
+func doHijack(w http.ResponseWriter) (net.Conn, []byte, error) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		return nil, caddyhttp.Error(http.StatusInternalServerError,
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError,
 			fmt.Errorf("ResponseWriter does not implement http.Hijacker"))
 	}
 	clientConn, bufReader, err := hijacker.Hijack()
 	if err != nil {
-		return nil, caddyhttp.Error(http.StatusInternalServerError,
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError,
 			fmt.Errorf("hijack failed: %v", err))
 	}
 	// bufReader may contain unprocessed buffered data from the client.
+	var buffered []byte
 	if bufReader != nil {
 		// snippet borrowed from `proxy` plugin
 		if n := bufReader.Reader.Buffered(); n > 0 {
 			rbuf, err := bufReader.Reader.Peek(n)
 			if err != nil {
-				return nil, caddyhttp.Error(http.StatusBadGateway, err)
+				_ = clientConn.Close()
+				return nil, nil, caddyhttp.Error(http.StatusBadGateway, err)
 			}
-			_, _ = targetConn.Write(rbuf)
+			buffered = append(buffered, rbuf...)
 		}
 	}
 	// Since we hijacked the connection, we lost the ability to write and flush headers via w.
-	// Let's handcraft the response and send it manually.
+	// Let's handcraft the response and send it manually, with the headers that w would have sent
+	// (e.g. Server and Alt-Svc set by Caddy), so that it looks like any other response of the server.
 	res := &http.Response{
 		StatusCode: http.StatusOK,
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     make(http.Header),
+		Header:     w.Header().Clone(),
 	}
-	res.Header.Set("Server", "Caddy")
 
 	buf := bufio.NewWriter(clientConn)
 	err = res.Write(buf)
 	if err != nil {
 		_ = clientConn.Close()
-		return nil, caddyhttp.Error(http.StatusInternalServerError,
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError,
 			fmt.Errorf("failed to write response: %v", err))
 	}
 	err = buf.Flush()
 	if err != nil {
 		_ = clientConn.Close()
-		return nil, caddyhttp.Error(http.StatusInternalServerError,
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError,
 			fmt.Errorf("failed to send response to client: %v", err))
 	}
-	return clientConn, nil
+	return clientConn, buffered, nil
 }
 
 // Hijacks the connection from ResponseWriter, writes the response and proxies data between targetConn
 // and hijacked connection.
-func (h *Handler) serveHijack(ctx context.Context, r io.ReadCloser, w http.ResponseWriter, targetConn net.Conn) error {
-	clientConn, err := doHijack(w, targetConn)
+func (h *Handler) serveHijack(ctx context.Context, r io.ReadCloser, w http.ResponseWriter, targetConn net.Conn,
+	inspect func(client io.Reader, prefix []byte) (int64, error)) error {
+	clientConn, buffered, err := doHijack(w)
 	if err != nil {
 		return err
 	}
@@ -694,7 +1192,7 @@ func (h *Handler) serveHijack(ctx context.Context, r io.ReadCloser, w http.Respo
 			clientConn = conn
 		}
 	}
-	clientRead, clientWritten, err := dualStream(ctx, targetConn, clientConn, clientConn)
+	clientRead, clientWritten, err := dualStream(ctx, targetConn, clientConn, clientConn, buffered, inspect)
 	rLength := reflect.ValueOf(r).Elem().FieldByName("Length")
 	if rLength.CanSet() {
 		rLength.SetInt(rLength.Int() + clientRead)
@@ -710,11 +1208,28 @@ func (h *Handler) serveHijack(ctx context.Context, r io.ReadCloser, w http.Respo
 // Copies data target->clientReader and clientWriter->target, and flushes as needed
 // Returns when clientWriter-> target stream is done.
 // Caddy should finish writing target -> clientReader.
-func dualStream(ctx context.Context, target net.Conn, clientReader io.ReadCloser, clientWriter io.Writer) (clientRead int64, clientWritten int64, err error) {
+// prefix is data already read from the client. If inspect is not nil, it is responsible for sending prefix and
+// the first bytes from clientReader to target, and aborts the stream by returning an error.
+func dualStream(ctx context.Context, target net.Conn, clientReader io.ReadCloser, clientWriter io.Writer, prefix []byte,
+	inspect func(client io.Reader, prefix []byte) (int64, error)) (clientRead int64, clientWritten int64, err error) {
 	errs, _ := errgroup.WithContext(ctx)
 	errs.Go(func() error {
+		if inspect != nil {
+			n, err := inspect(clientReader, prefix)
+			clientRead = n
+			if err != nil {
+				_ = target.Close()
+				return err
+			}
+		} else if len(prefix) > 0 {
+			n, err := target.Write(prefix)
+			clientRead = int64(n)
+			if err != nil {
+				return err
+			}
+		}
 		n, err := flushingIoCopy(target, clientReader, true)
-		clientRead = n
+		clientRead += n
 		return err
 	})
 	errs.Go(func() error {
@@ -814,14 +1329,6 @@ var hopByHopHeaders = []string{
 	"Transfer-Encoding",
 }
 
-const pacFile = `
-function FindProxyForURL(url, host) {
-	if (host === "127.0.0.1" || host === "::1" || host === "localhost")
-		return "DIRECT";
-	return "HTTPS %s";
-}
-`
-
 ////// used during provision only
 
 func isLocalhost(hostname string) bool {
@@ -830,6 +1337,11 @@ func isLocalhost(hostname string) bool {
 		hostname == "::1"
 }
 
+const (
+	upstreamACLHostname = "hostname"
+	upstreamACLResolve  = "resolve"
+)
+
 type dialContexter interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
@@ -837,6 +1349,69 @@ type dialContexter interface {
 // ProbeResistance configures probe resistance.
 type ProbeResistance struct {
 	Domain string `json:"domain,omitempty"`
+
+	// Minimum time from receiving a request to acting on its authentication, so that failed attempts
+	// (passed to the next handler) cannot be told apart from successful ones by timing. For CONNECT, it also
+	// covers dialing the target, before the response. It should be longer than checking credentials can take,
+	// e.g. with password hashes or auth_url, and than dials usually take. Applies to proxy requests and to requests
+	// with Proxy-Authorization, but not to visitors of the website. Default: 0.
+	AuthPadding caddy.Duration `json:"auth_padding,omitempty"`
+
+	// Random delay of up to AuthJitter added on top of AuthPadding. Default: 0.
+	AuthJitter caddy.Duration `json:"auth_jitter,omitempty"`
+
+	// Replaces the page that authenticated clients get on Domain.
+	Page *HiddenPage `json:"page,omitempty"`
+
+	// Paths that a client has to fetch in this order, with GET or HEAD requests to any host, to unlock the proxy
+	// for its IP address. Unauthenticated proxy requests from unlocked clients get 407 Proxy Authentication Required,
+	// as if probe resistance was disabled, instead of being passed to the next handler. The knocks themselves are
+	// passed to the next handler too. Proxy requests for absolute URLs are not knocks. Requests for the website itself
+	// should be matched by Hosts, so that unlocked clients can still visit it. Default: none.
+	KnockPaths []string `json:"knock_paths,omitempty"`
+
+	// How long the proxy stays unlocked after the last knock. Default: 10m.
+	UnlockDuration caddy.Duration `json:"unlock_duration,omitempty"`
+
+	// Longest time between knocks of the sequence. Default: 30s.
+	KnockTimeout caddy.Duration `json:"knock_timeout,omitempty"`
+
+	knocks knockTable
+
+	clock func() time.Time                           // for tests; default: time.Now
+	sleep func(ctx context.Context, d time.Duration) // for tests
+}
+
+func (p *ProbeResistance) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+// equalizeTiming waits until AuthPadding has passed since start, plus a random jitter, or until r is canceled.
+// Only proxy requests and requests with credentials are delayed, as the website would not be.
+func (p *ProbeResistance) equalizeTiming(r *http.Request, start time.Time) {
+	if !isProxyRequest(r) && len(r.Header.Get("Proxy-Authorization")) == 0 {
+		return
+	}
+	delay := time.Duration(p.AuthPadding) - p.now().Sub(start)
+	if p.AuthJitter > 0 {
+		delay += time.Duration(mathrand.Int63n(int64(p.AuthJitter)))
+	}
+	if delay <= 0 {
+		return
+	}
+	if p.sleep != nil {
+		p.sleep(r.Context(), delay)
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
 }
 
 func readLinesFromFile(filename string) ([]string, error) {
@@ -856,9 +1431,18 @@ func readLinesFromFile(filename string) ([]string, error) {
 	return hostnames, scanner.Err()
 }
 
+// Cleanup releases what the handler shares with other instances.
+func (h *Handler) Cleanup() error {
+	if h.UserQuota != nil {
+		return h.UserQuota.cleanup()
+	}
+	return nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 	_ caddyfile.Unmarshaler       = (*Handler)(nil)
 )
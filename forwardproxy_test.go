@@ -16,16 +16,24 @@ package forwardproxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Mygod/nonlocalforwardproxy/httpclient"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"golang.org/x/net/http2"
 )
 
@@ -331,6 +339,15 @@ func TestConnectAuthWrong(t *testing.T) {
 	}
 }
 
+// pacFile is the default PAC file, for the host and port of the proxy.
+const pacFile = `
+function FindProxyForURL(url, host) {
+	if (host === "127.0.0.1" || host === "::1" || host === "localhost")
+		return "DIRECT";
+	return "HTTPS %s";
+}
+`
+
 func TestPAC(t *testing.T) {
 	client := &http.Client{Transport: testTransport, Timeout: 2 * time.Second}
 	resp, err := client.Get("https://" + caddyForwardProxy.addr + "/proxy.pac")
@@ -350,6 +367,245 @@ func TestPAC(t *testing.T) {
 	}
 }
 
+func TestPACConfig(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		acl {
+			allow *.example.net
+			deny example.org 192.0.2.0/24
+		}
+		serve_pac {
+			proxy HTTPS {http.request.hostport}
+			proxy PROXY proxy.example.com:8080
+			proxy DIRECT
+			bypass *.lan 10.0.0.0/8
+			only *.example.com *.example.net example.org
+			use_acl
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/proxy.pac", nil)
+	const expected = `
+function FindProxyForURL(url, host) {
+	var address = null;
+	function ip() {
+		if (address === null)
+			address = dnsResolve(host) || "";
+		return address;
+	}
+	if (host === "127.0.0.1" || host === "::1" || host === "localhost")
+		return "DIRECT";
+	if (host === "lan" || dnsDomainIs(host, ".lan") || isInNet(ip(), "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (!(host === "example.com" || dnsDomainIs(host, ".example.com") || host === "example.net" || dnsDomainIs(host, ".example.net") || host === "example.org"))
+		return "DIRECT";
+	if (host === "example.net" || dnsDomainIs(host, ".example.net"))
+		return "HTTPS proxy.example.com; PROXY proxy.example.com:8080; DIRECT";
+	if (host === "example.org")
+		return "DIRECT";
+	if (isInNet(ip(), "192.0.2.0", "255.255.255.0"))
+		return "DIRECT";
+	return "HTTPS proxy.example.com; PROXY proxy.example.com:8080; DIRECT";
+}
+`
+	if pac := h.PAC.generate(caddyhttp.NewTestReplacer(r)); pac != expected {
+		t.Fatal("Unexpected PAC file:", pac)
+	}
+
+	// the client cannot tell what the proxy would do from the category rule on
+	dbPath := filepath.Join(t.TempDir(), "categories.txt")
+	if err := os.WriteFile(dbPath, []byte("work.example,work\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h = Handler{}
+	d = caddyfile.NewTestDispenser(`forward_proxy {
+		category_database ` + dbPath + `
+		acl {
+			deny example.org 2001:db8::/32
+			allow category:work
+			deny all
+		}
+		serve_pac {
+			use_acl
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	if pac := h.PAC.generate(caddyhttp.NewTestReplacer(r)); !strings.HasSuffix(pac, `	if (host === "example.org")
+		return "DIRECT";
+	return "HTTPS proxy.example.com";
+}
+`) || strings.Contains(pac, "ip()") {
+		t.Fatal("Unexpected PAC file:", pac)
+	}
+
+	for _, config := range []string{"proxy HTTPS", "proxy FTP example.com:21", "bypass category:ads", "only all",
+		"bypass 2001:db8::/32"} {
+		h = Handler{}
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\nserve_pac {\n" + config + "\n}\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+			t.Fatalf("Expected %s to be rejected", config)
+		}
+	}
+}
+
+func TestPACPerUser(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth alice pass
+		basic_auth bob pass
+		hosts localhost
+		serve_pac {
+			proxy HTTPS {http.forward_proxy.pac_user}.proxy.example.com:443
+			per_user /pac/ s3cr3t
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	if h.PACPath != "" {
+		t.Fatal("Expected no shared PAC file, got:", h.PACPath)
+	}
+	var passed bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		passed = true
+		return nil
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://localhost"+path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+		w := httptest.NewRecorder()
+		passed = false
+		if err := h.ServeHTTP(w, r, next); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	aliceToken, bobToken := h.PAC.userToken("alice"), h.PAC.userToken("bob")
+	if aliceToken == bobToken {
+		t.Fatal("Expected users to have different tokens")
+	}
+	if w := get("/pac/" + aliceToken + ".pac"); passed || !strings.Contains(w.Body.String(), `"HTTPS alice.proxy.example.com:443"`) {
+		t.Fatal("Unexpected PAC file of alice:", w.Body.String())
+	}
+	if w := get("/pac/" + bobToken + ".pac"); passed || !strings.Contains(w.Body.String(), `"HTTPS bob.proxy.example.com:443"`) {
+		t.Fatal("Unexpected PAC file of bob:", w.Body.String())
+	}
+	for _, path := range []string{"/proxy.pac", "/pac/" + aliceToken[1:] + ".pac", "/pac/" + aliceToken, "/pac/.pac",
+		"/other/" + aliceToken + ".pac"} {
+		if get(path); !passed {
+			t.Fatalf("Expected %s to be passed to the next handler", path)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+	if url := h.pacURL(r, "alice"); url != "https://localhost/pac/"+aliceToken+".pac" {
+		t.Fatal("Unexpected PAC URL of alice:", url)
+	}
+	if url := h.pacURL(r, "mallory"); url != "" {
+		t.Fatal("Expected no PAC URL for unknown users, got:", url)
+	}
+
+	// as when alice is removed from a reloaded auth_file
+	h.PAC.loadUsers([]string{"bob"})
+	if get("/pac/" + aliceToken + ".pac"); !passed {
+		t.Fatal("Expected the PAC file of a removed user to be passed to the next handler")
+	}
+	if url := h.pacURL(r, "alice"); url != "" {
+		t.Fatal("Expected no PAC URL for removed users, got:", url)
+	}
+}
+
+func TestWPAD(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth alice pass
+		serve_pac {
+			proxy HTTPS proxy.example.lan:443
+			wpad wpad wpad.*
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	var passed bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		passed = true
+		return nil
+	})
+	for _, c := range []struct {
+		client, host, path string
+		served             bool
+	}{
+		{"192.168.1.10", "wpad", "/wpad.dat", true},
+		{"10.1.2.3", "wpad.lan", "/wpad.dat", true},
+		{"fe80::1", "WPAD.lan:80", "/wpad.dat", true},
+		{"192.168.1.10", "wpad.example.lan", "/wpad.dat", false},
+		{"192.168.1.10", "example.lan", "/wpad.dat", false},
+		{"192.168.1.10", "wpad.lan", "/proxy.pac", false},
+		{"203.0.113.1", "wpad.lan", "/wpad.dat", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.Host = c.host
+		r.RemoteAddr = net.JoinHostPort(c.client, "12345")
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+		w := httptest.NewRecorder()
+		passed = false
+		err := h.ServeHTTP(w, r, next)
+		if !c.served {
+			if passed {
+				continue
+			}
+			if handlerErr, ok := err.(caddyhttp.HandlerError); ok && handlerErr.StatusCode == http.StatusProxyAuthRequired {
+				continue
+			}
+			t.Fatalf("Expected %s%s not to serve the PAC file, got: %v", c.host, c.path, err)
+		}
+		if err != nil || passed {
+			t.Fatalf("Expected %s%s to serve the PAC file, got: %v", c.host, c.path, err)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ns-proxy-autoconfig" {
+			t.Fatal("Unexpected Content-Type:", contentType)
+		}
+		if !strings.Contains(w.Body.String(), `return "HTTPS proxy.example.lan:443";`) {
+			t.Fatal("Unexpected PAC file:", w.Body.String())
+		}
+	}
+
+	for _, config := range []string{
+		"serve_pac {\n wpad wpad \n}",
+		"probe_resistance\n serve_pac {\n proxy HTTPS proxy.example.lan:443\n wpad wpad\n}",
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\n basic_auth alice pass\n" + config + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+	if err := (&Handler{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\n serve_pac {\n wpad\n }\n}")); err == nil {
+		t.Error("Expected wpad to require hosts")
+	}
+}
+
 func TestCONNECTViaUpstream(t *testing.T) {
 	const useTLS = true
 	for range make([]byte, 5) { // do several times to test http2 connection reuse
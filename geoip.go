@@ -0,0 +1,79 @@
+package forwardproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPDB looks up the country and autonomous system of IP addresses in local MaxMind DB (mmdb) files,
+// such as GeoLite2-Country and GeoLite2-ASN. Databases are read into memory, so that they can be
+// replaced while lookups are in progress.
+type geoIPDB struct {
+	paths   []string
+	readers atomic.Pointer[[]*maxminddb.Reader]
+}
+
+// geoIPRecord holds the fields used by ACL rules, from any of the supported database types.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+func newGeoIPDB(paths []string) (*geoIPDB, error) {
+	db := &geoIPDB{paths: paths}
+	return db, db.reload()
+}
+
+// reload replaces the databases with the current contents of their files, or leaves them as is if they cannot be loaded.
+func (db *geoIPDB) reload() error {
+	readers := make([]*maxminddb.Reader, len(db.paths))
+	for i, path := range db.paths {
+		buf, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return err
+		}
+		if readers[i], err = maxminddb.FromBytes(buf); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	db.readers.Store(&readers)
+	return nil
+}
+
+// lookup merges what the databases know about ip. Addresses a database cannot look up are skipped.
+func (db *geoIPDB) lookup(ip net.IP) (record geoIPRecord) {
+	for _, reader := range *db.readers.Load() {
+		var r geoIPRecord
+		if reader.Lookup(ip, &r) != nil {
+			continue
+		}
+		if len(record.Country.ISOCode) == 0 {
+			record.Country.ISOCode = r.Country.ISOCode
+		}
+		if record.ASN == 0 {
+			record.ASN = r.ASN
+		}
+	}
+	return
+}
+
+// parseASN parses an autonomous system number written as AS12345 or 12345.
+func parseASN(s string) (uint, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	asn, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, fmt.Errorf("invalid autonomous system number: %s", s)
+	}
+	return uint(asn), nil
+}
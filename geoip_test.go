@@ -0,0 +1,166 @@
+package forwardproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// mmdbWriter encodes values in the MaxMind DB data format, just enough to build test databases.
+type mmdbWriter []byte
+
+func (w *mmdbWriter) control(typ byte, size int) {
+	if typ > 7 {
+		*w = append(*w, byte(size), typ-7)
+	} else {
+		*w = append(*w, typ<<5|byte(size))
+	}
+}
+
+func (w *mmdbWriter) string(s string) {
+	w.control(2, len(s))
+	*w = append(*w, s...)
+}
+
+func (w *mmdbWriter) uint16(v uint16) {
+	w.control(5, 2)
+	*w = binary.BigEndian.AppendUint16(*w, v)
+}
+
+func (w *mmdbWriter) uint32(v uint32) {
+	w.control(6, 4)
+	*w = binary.BigEndian.AppendUint32(*w, v)
+}
+
+// buildTestMMDB builds an IPv4 database mapping each network to a country and an autonomous system number.
+func buildTestMMDB(t *testing.T, networks map[string]geoIPRecord) []byte {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data mmdbWriter
+	var dataOffsets []int
+	for cidr, record := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - len(dataOffsets)
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		dataOffsets = append(dataOffsets, len(data))
+		data.control(7, 2)
+		data.string("country")
+		data.control(7, 1)
+		data.string("iso_code")
+		data.string(record.Country.ISOCode)
+		data.string("autonomous_system_number")
+		data.uint32(uint32(record.ASN))
+	}
+
+	var db []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			switch {
+			case record == empty:
+				record = len(nodes)
+			case record < empty:
+				record = len(nodes) + 16 + dataOffsets[-2-record]
+			}
+			db = binary.BigEndian.AppendUint32(db, uint32(record))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+
+	metadata := mmdbWriter("\xAB\xCD\xEFMaxMind.com")
+	metadata.control(7, 8)
+	metadata.string("node_count")
+	metadata.uint32(uint32(len(nodes)))
+	metadata.string("record_size")
+	metadata.uint16(32)
+	metadata.string("ip_version")
+	metadata.uint16(4)
+	metadata.string("database_type")
+	metadata.string("Test")
+	metadata.string("languages")
+	metadata.control(11, 0)
+	metadata.string("binary_format_major_version")
+	metadata.uint16(2)
+	metadata.string("binary_format_minor_version")
+	metadata.uint16(0)
+	metadata.string("description")
+	metadata.control(7, 0)
+	return append(db, metadata...)
+}
+
+func TestGeoIPRules(t *testing.T) {
+	var nl, us geoIPRecord
+	nl.Country.ISOCode, nl.ASN = "NL", 1136
+	us.Country.ISOCode, us.ASN = "US", 15169
+	dbPath := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(dbPath, buildTestMMDB(t, map[string]geoIPRecord{
+		"1.0.0.0/8":  nl,
+		"8.8.8.0/24": us,
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := Handler{
+		ACL:            []ACLRule{{Subjects: []string{"country:nl", "asn:AS15169"}}},
+		GeoIPDatabases: []string{dbPath},
+	}
+	if err := h.Provision(caddy.Context{Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, expected := range map[string]bool{
+		"1.2.3.4": false,
+		"8.8.8.8": false,
+		"8.8.4.4": true,
+		"9.9.9.9": true,
+		"2620::1": true,
+	} {
+		if allowed, rule := h.hostIsAllowed("example.com", net.ParseIP(ip)); allowed != expected {
+			t.Errorf("Expected %s to be allowed: %v, got decision by %v", ip, expected, rule)
+		}
+	}
+}
+
+func TestDatabaseReloadInterval(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		database_reload_interval 10s
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if h.DatabaseReloadInterval != caddy.Duration(10*time.Second) {
+		t.Fatal("Expected database_reload_interval to be 10s, got:", time.Duration(h.DatabaseReloadInterval))
+	}
+	// the one interval covers every database, so there is no option per database
+	for _, option := range []string{"geoip_reload_interval", "category_reload_interval"} {
+		d = caddyfile.NewTestDispenser("forward_proxy {\n" + option + " 10s\n}")
+		if err := (&Handler{}).UnmarshalCaddyfile(d); err == nil {
+			t.Fatalf("Expected %s to be rejected", option)
+		}
+	}
+}
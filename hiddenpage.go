@@ -0,0 +1,92 @@
+package forwardproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// HiddenPage replaces the page that authenticated clients get on the secret domain of probe resistance,
+// e.g. with setup instructions for proxy clients, or a decoy. Header values and the body may contain placeholders,
+// such as {http.request.host} or {http.auth.user.id}, and these:
+//   - {http.forward_proxy.pac_url}: URL of the PAC file of the user, if it is served
+//   - {http.forward_proxy.quota.tunnels}: concurrent tunnels of the user
+//   - {http.forward_proxy.quota.max_tunnels}: limit on them, 0 if none
+//   - {http.forward_proxy.quota.daily_bytes} and {http.forward_proxy.quota.monthly_bytes}:
+//     traffic of the user today and this month
+//   - {http.forward_proxy.quota.daily_limit} and {http.forward_proxy.quota.monthly_limit}: limits on them, 0 if none
+//
+// The quota placeholders are only set with user_quota. Only placeholders are replaced: this is not a Caddy template.
+type HiddenPage struct {
+	// From 200 to 599, as informational responses would be followed by another one. Default: 200.
+	Status int `json:"status,omitempty"`
+
+	// Headers to set.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Response body.
+	Body string `json:"body,omitempty"`
+
+	// File with the response body, read once at startup, instead of Body.
+	BodyFile string `json:"body_file,omitempty"`
+}
+
+func (p *HiddenPage) provision() error {
+	if p.Status == 0 {
+		p.Status = http.StatusOK
+	}
+	if p.Status < 200 || p.Status > 599 {
+		return fmt.Errorf("invalid status: %d", p.Status)
+	}
+	if len(p.BodyFile) > 0 {
+		if len(p.Body) > 0 {
+			return errors.New("body and body_file cannot be used together")
+		}
+		body, err := os.ReadFile(filepath.Clean(p.BodyFile))
+		if err != nil {
+			return err
+		}
+		p.Body = string(body)
+	}
+	return nil
+}
+
+// setHiddenPagePlaceholders sets the placeholders that a HiddenPage can use for the authenticated client of r.
+func (h Handler) setHiddenPagePlaceholders(r *http.Request, repl *caddy.Replacer) {
+	user, _ := repl.GetString("http.auth.user.id")
+	if pacURL := h.pacURL(r, user); len(pacURL) > 0 {
+		repl.Set("http.forward_proxy.pac_url", pacURL)
+	}
+	quotaUser := h.quotaUser(r)
+	if len(quotaUser) == 0 {
+		return
+	}
+	usage := h.UserQuota.snapshot(quotaUser, time.Now())
+	repl.Set("http.forward_proxy.quota.tunnels", strconv.Itoa(usage.tunnels))
+	repl.Set("http.forward_proxy.quota.max_tunnels", strconv.Itoa(h.UserQuota.MaxTunnels))
+	repl.Set("http.forward_proxy.quota.daily_bytes", strconv.FormatInt(usage.DayBytes, 10))
+	repl.Set("http.forward_proxy.quota.daily_limit", strconv.FormatInt(h.UserQuota.DailyBytes, 10))
+	repl.Set("http.forward_proxy.quota.monthly_bytes", strconv.FormatInt(usage.MonthBytes, 10))
+	repl.Set("http.forward_proxy.quota.monthly_limit", strconv.FormatInt(h.UserQuota.MonthlyBytes, 10))
+}
+
+// writeHiddenPage responds with the configured HiddenPage.
+func (h Handler) writeHiddenPage(w http.ResponseWriter, r *http.Request) {
+	page := h.ProbeResistance.Page
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	h.setHiddenPagePlaceholders(r, repl)
+	for name, values := range page.Headers {
+		w.Header().Del(name)
+		for _, value := range values {
+			w.Header().Add(name, repl.ReplaceKnown(value, ""))
+		}
+	}
+	w.WriteHeader(page.Status)
+	_, _ = w.Write([]byte(repl.ReplaceKnown(page.Body, "")))
+}
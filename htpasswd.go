@@ -0,0 +1,160 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"crypto/md5"  // #nosec G501 -- required by the APR1 format
+	"crypto/sha1" // #nosec G505 -- required by the {SHA} format
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadHtpasswdFile reads users from an Apache htpasswd file, with one user:hash entry per line.
+// Empty lines and lines starting with # are ignored.
+func loadHtpasswdFile(path string) ([]AuthUser, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users []AuthUser
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if len(entry) == 0 || entry[0] == '#' {
+			continue
+		}
+		username, hash, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err = parsePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: %v", path, line, username, err)
+		}
+		users = append(users, AuthUser{Username: username, Password: hash})
+	}
+	return users, scanner.Err()
+}
+
+// sha1Hash is the {SHA} format of htpasswd: base64 of the unsalted SHA-1 of the password.
+type sha1Hash struct {
+	hash    string
+	derived []byte
+}
+
+func parseSHA1Hash(hash string) (*sha1Hash, error) {
+	derived, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SHA}"))
+	if err != nil || len(derived) != sha1.Size {
+		return nil, errors.New("malformed {SHA} hash")
+	}
+	return &sha1Hash{hash: hash, derived: derived}, nil
+}
+
+func (h *sha1Hash) verify(password string) bool {
+	derived := sha1.Sum([]byte(password)) // #nosec G401
+	return subtle.ConstantTimeCompare(derived[:], h.derived) == 1
+}
+
+func (h *sha1Hash) String() string {
+	return h.hash
+}
+
+func (h *sha1Hash) cost() float64 {
+	return 1
+}
+
+// apr1Hash is Apache's variant of MD5-crypt: $apr1$<salt>$<hash>.
+type apr1Hash struct {
+	hash string
+	salt string
+}
+
+func parseAPR1Hash(hash string) (*apr1Hash, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || len(fields[2]) > 8 || len(fields[3]) != 22 {
+		return nil, errors.New("malformed apr1 hash")
+	}
+	return &apr1Hash{hash: hash, salt: fields[2]}, nil
+}
+
+func (h *apr1Hash) verify(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(apr1Crypt(password, h.salt)), []byte(h.hash)) == 1
+}
+
+func (h *apr1Hash) String() string {
+	return h.hash
+}
+
+func (h *apr1Hash) cost() float64 {
+	return 1000
+}
+
+// apr1Crypt computes the $apr1$ hash of password with salt, like `htpasswd -m` does.
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	pw := []byte(password)
+
+	alt := md5.New() // #nosec G401
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New() // #nosec G401
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New() // #nosec G401
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return magic + salt + "$" + string(out)
+}
@@ -102,6 +102,16 @@ func (c *HTTPConnectDialer) Dial(network, address string) (net.Conn, error) {
 	return c.DialContext(context.Background(), network, address)
 }
 
+// StatusError is returned when the proxy answers CONNECT with another status than 200 OK:
+// the proxy itself works, but did not connect to the target.
+type StatusError struct {
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "Proxy responded with non 200 code: " + e.Status
+}
+
 // Users of context.WithValue should define their own types for keys
 type ContextKeyHeader struct{}
 
@@ -138,7 +148,7 @@ func (c *HTTPConnectDialer) DialContext(ctx context.Context, network, address st
 
 		if resp.StatusCode != http.StatusOK {
 			_ = rawConn.Close()
-			return nil, errors.New("Proxy responded with non 200 code: " + resp.Status)
+			return nil, &StatusError{Status: resp.Status}
 		}
 		return NewHttp2Conn(rawConn, pw, resp.Body), nil
 	}
@@ -162,7 +172,7 @@ func (c *HTTPConnectDialer) DialContext(ctx context.Context, network, address st
 
 		if resp.StatusCode != http.StatusOK {
 			_ = rawConn.Close()
-			return nil, errors.New("Proxy responded with non 200 code: " + resp.Status)
+			return nil, &StatusError{Status: resp.Status}
 		}
 		return rawConn, nil
 	}
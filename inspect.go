@@ -0,0 +1,178 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// tunnelInspectLimit bounds how much of the client's first bytes are buffered while looking for a hostname.
+// It fits the largest TLS record, so that a ClientHello sent in a single record can always be parsed.
+const tunnelInspectLimit = 5 + 16384
+
+// errTunnelUnparsable is returned for tunnels that start like TLS or HTTP, but in which no hostname can be found
+// within tunnelInspectLimit, as they could be hiding a denied hostname.
+var errTunnelUnparsable = errors.New("malformed or oversized TLS ClientHello or HTTP request")
+
+// inspectTunnel reads the first bytes sent by the client through a CONNECT tunnel, and if they reveal which
+// host the client actually talks to (TLS SNI or HTTP Host), re-evaluates the ACL against that host.
+// Bytes that were read (including prefix, which was already read from the client) are forwarded to target,
+// unless the host is denied, or they look like TLS or HTTP but cannot be parsed. Returns how many bytes were forwarded.
+// Only the first request of plaintext HTTP tunnels is inspected. target goes through upstreams, unless it is nil.
+// The host is only checked: the tunnel stays on the route chosen for the CONNECT target, even if host has another one.
+func (h Handler) inspectTunnel(ctx context.Context, target net.Conn, upstreams *upstreamPool, client io.Reader,
+	prefix []byte) (int64, error) {
+	buf := make([]byte, len(prefix), tunnelInspectLimit+len(prefix))
+	copy(buf, prefix)
+	host, done, err := sniffHostname(buf)
+	for !done && len(buf) < cap(buf) {
+		n, readErr := client.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if host, done, err = sniffHostname(buf); readErr != nil {
+			break // let the relay report the error, if any
+		}
+	}
+	if err == nil && !done && len(buf) > 0 {
+		err = errTunnelUnparsable
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot inspect tunnel: %w", err)
+	}
+	if len(host) > 0 {
+		if err := h.checkTunnelHost(ctx, host, target, upstreams); err != nil {
+			return 0, err
+		}
+	}
+	n, err := target.Write(buf)
+	return int64(n), err
+}
+
+// checkTunnelHost evaluates the ACL as if the client had asked for host, and it resolved to the address of target,
+// or as if upstreams were asked to connect to host.
+func (h Handler) checkTunnelHost(ctx context.Context, host string, target net.Conn, upstreams *upstreamPool) error {
+	if upstreams != nil {
+		return h.checkUpstreamACL(ctx, host)
+	}
+	var ip net.IP
+	if addr, ok := target.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if allowed, rule := h.hostIsAllowed(host, ip); !allowed {
+		return h.aclDenied("disallowed tunnel host "+host, host, ip, rule)
+	}
+	return nil
+}
+
+// sniffHostname looks for the destination hostname in the first bytes of a TLS or plaintext HTTP stream.
+// done is false if more bytes are needed to tell, and err is errTunnelUnparsable if they cannot be parsed.
+// Other protocols have no hostname.
+func sniffHostname(data []byte) (host string, done bool, err error) {
+	if len(data) == 0 {
+		return "", false, nil
+	}
+	if data[0] == 0x16 { // TLS handshake record
+		return sniffTLSServerName(data)
+	}
+	i := 0
+	for i < len(data) && 'A' <= data[i] && data[i] <= 'Z' {
+		i++
+	}
+	if i == len(data) {
+		return "", false, nil
+	}
+	if i == 0 || data[i] != ' ' { // does not start with an HTTP method
+		return "", true, nil
+	}
+	if !bytes.Contains(data, []byte("\r\n\r\n")) {
+		return "", false, nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", true, errTunnelUnparsable
+	}
+	if len(req.Host) == 0 {
+		// e.g. the preface of h2c with prior knowledge (PRI * HTTP/2.0), whose :authority comes in a later frame
+		return "", true, errTunnelUnparsable
+	}
+	if host, _, err = net.SplitHostPort(req.Host); err != nil {
+		host = req.Host
+	}
+	return host, true, nil
+}
+
+// sniffTLSServerName reassembles the ClientHello from the TLS records in data and returns its SNI.
+func sniffTLSServerName(data []byte) (string, bool, error) {
+	var handshake []byte
+	for {
+		if len(data) < 5 {
+			return "", false, nil
+		}
+		if data[0] != 0x16 {
+			return "", true, errTunnelUnparsable
+		}
+		length := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+length {
+			return "", false, nil
+		}
+		handshake = append(handshake, data[5:5+length]...)
+		data = data[5+length:]
+		if len(handshake) >= 4 {
+			length = int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+length {
+				name, ok := parseClientHelloServerName(handshake[:4+length])
+				if !ok {
+					return "", true, errTunnelUnparsable
+				}
+				return name, true, nil
+			}
+		}
+	}
+}
+
+// parseClientHelloServerName extracts the server_name extension from a ClientHello handshake message.
+// ok is false if the message is malformed, and name is empty if it has no server_name.
+func parseClientHelloServerName(handshake []byte) (name string, ok bool) {
+	s := cryptobyte.String(handshake)
+	var msgType uint8
+	var hello, sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&hello) ||
+		!hello.Skip(2+32) || // legacy_version, random
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!hello.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!hello.ReadUint16LengthPrefixed(&extensions) {
+		return "", false
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return "", false
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		var names cryptobyte.String
+		if !extData.ReadUint16LengthPrefixed(&names) {
+			return "", false
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var hostName cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&hostName) {
+				return "", false
+			}
+			if nameType == 0 { // host_name
+				return string(hostName), true
+			}
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,78 @@
+package forwardproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestSniffHostname(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_ = tls.Client(clientConn, &tls.Config{ServerName: "blocked.example.com"}).Handshake()
+	}()
+	buf := make([]byte, tunnelInspectLimit)
+	var data []byte
+	for {
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, buf[:n]...)
+		if _, done, _ := sniffHostname(data); done {
+			break
+		}
+	}
+	_ = serverConn.Close()
+	if host, _, err := sniffHostname(data); err != nil || host != "blocked.example.com" {
+		t.Fatalf("Expected SNI blocked.example.com, got: %q", host)
+	}
+	if _, done, _ := sniffHostname(data[:len(data)-1]); done {
+		t.Fatal("Expected a truncated ClientHello to need more data")
+	}
+
+	httpRequest := []byte("GET / HTTP/1.1\r\nHost: blocked.example.com:8080\r\n\r\n")
+	if host, done, _ := sniffHostname(httpRequest); !done || host != "blocked.example.com" {
+		t.Fatalf("Expected HTTP host blocked.example.com, got: %q", host)
+	}
+	if _, done, _ := sniffHostname(httpRequest[:20]); done {
+		t.Fatal("Expected incomplete HTTP headers to need more data")
+	}
+	if host, done, err := sniffHostname([]byte("SSH-2.0-OpenSSH_9.6\r\n")); !done || err != nil || host != "" {
+		t.Fatalf("Expected no hostname from an unknown protocol, got: %q", host)
+	}
+	if _, _, err := sniffHostname([]byte("GET / HTTP/1.1\r\nHost\r\n\r\n")); err == nil {
+		t.Fatal("Expected a malformed HTTP request to be rejected")
+	}
+	if _, _, err := sniffHostname([]byte("GET / HTTP/1.0\r\n\r\n")); err == nil {
+		t.Fatal("Expected an HTTP request without Host to be rejected")
+	}
+	if _, _, err := sniffHostname([]byte{0x16, 3, 1, 0, 4, 1, 0, 0, 0}); err == nil {
+		t.Fatal("Expected a malformed ClientHello to be rejected")
+	}
+}
+
+func TestInspectTunnelFailsClosed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"long HTTP headers": []byte("GET / HTTP/1.1\r\nX-Padding: " + strings.Repeat("a", tunnelInspectLimit) +
+			"\r\nHost: blocked.example.com\r\n\r\n"),
+		"oversized ClientHello":  append([]byte{0x16, 3, 1, 0x40, 0, 1, 0xff, 0xff, 0xff}, make([]byte, tunnelInspectLimit)...),
+		"truncated HTTP request": []byte("GET / HTTP/1.1\r\nHost: blocked.example.com\r\n"),
+		"h2c preface":            []byte(http2.ClientPreface),
+	} {
+		target, server := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+		n, err := Handler{}.inspectTunnel(context.Background(), target, nil, bytes.NewReader(data), nil)
+		if !errors.Is(err, errTunnelUnparsable) || n != 0 {
+			t.Errorf("Expected %s to be rejected, got: %d, %v", name, n, err)
+		}
+		_ = target.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package forwardproxy
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// knockTable tracks, by client IP, how far clients got in the knock sequence of probe resistance,
+// and until when they unlocked the proxy. Entries are swept once expired, whenever the table
+// has doubled in size since the last sweep.
+type knockTable struct {
+	mu        sync.Mutex
+	clients   map[string]*knockState
+	nextSweep int
+}
+
+type knockState struct {
+	progress int       // knocks of the sequence done so far
+	expires  time.Time // when the progress, or the unlock once it is complete, is forgotten
+}
+
+func (p *ProbeResistance) provisionKnocks() error {
+	if len(p.KnockPaths) == 0 {
+		if p.UnlockDuration != 0 || p.KnockTimeout != 0 {
+			return errors.New("unlock_duration and knock_timeout require knock paths")
+		}
+		return nil
+	}
+	for _, path := range p.KnockPaths {
+		if !strings.HasPrefix(path, "/") {
+			return errors.New("knock paths must start with /")
+		}
+	}
+	if p.UnlockDuration == 0 {
+		p.UnlockDuration = caddy.Duration(10 * time.Minute)
+	}
+	if p.KnockTimeout == 0 {
+		p.KnockTimeout = caddy.Duration(30 * time.Second)
+	}
+	if p.UnlockDuration < 0 || p.KnockTimeout < 0 {
+		return errors.New("durations cannot be negative")
+	}
+	p.knocks.clients = make(map[string]*knockState)
+	return nil
+}
+
+// knock records that ip fetched path. Fetching the first path of the sequence (re)starts it, fetching the next
+// one moves it on, and fetching any other of its paths resets it. Other paths do not matter, as browsers may
+// fetch more (e.g. favicon.ico) along the way.
+func (p *ProbeResistance) knock(ip, path string, now time.Time) {
+	t := &p.knocks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[ip]
+	if state != nil && !now.Before(state.expires) {
+		state = nil
+	}
+	switch {
+	case state != nil && state.progress == len(p.KnockPaths): // already unlocked
+		return
+	case state != nil && p.KnockPaths[state.progress] == path:
+		state.progress++
+	case p.KnockPaths[0] == path:
+		state = &knockState{progress: 1}
+	case state != nil && slices.Contains(p.KnockPaths, path):
+		delete(t.clients, ip)
+		return
+	default:
+		return
+	}
+	if state.progress == len(p.KnockPaths) {
+		state.expires = now.Add(time.Duration(p.UnlockDuration))
+	} else {
+		state.expires = now.Add(time.Duration(p.KnockTimeout))
+	}
+	if _, ok := t.clients[ip]; !ok && len(t.clients) >= t.nextSweep {
+		for client, s := range t.clients {
+			if !now.Before(s.expires) {
+				delete(t.clients, client)
+			}
+		}
+		t.nextSweep = 2*len(t.clients) + 64
+	}
+	t.clients[ip] = state
+}
+
+// unlocked returns whether ip has completed the knock sequence, and its unlock has not expired yet.
+func (p *ProbeResistance) unlocked(ip string, now time.Time) bool {
+	if len(p.KnockPaths) == 0 {
+		return false
+	}
+	t := &p.knocks
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.clients[ip]
+	return state != nil && state.progress == len(p.KnockPaths) && now.Before(state.expires)
+}
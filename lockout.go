@@ -0,0 +1,200 @@
+package forwardproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// AuthLockout slows down guessing of proxy credentials. Failed attempts are counted per client IP and per
+// username (of Basic or Digest credentials); after MaxFailures of them, the IP or username is locked out for Lockout,
+// which doubles with every further lockout up to MaxLockout. Counters are forgotten after MaxLockout without failures.
+//
+// Only requests that carry Proxy-Authorization count as attempts, so that clients without credentials
+// (e.g. visitors of the website when probe resistance is enabled) are never locked out.
+// Errors of ForwardAuth are not failed attempts either.
+type AuthLockout struct {
+	// Failed attempts before a lockout. Default: 5.
+	MaxFailures int `json:"max_failures,omitempty"`
+
+	// Duration of the first lockout. Default: 1m.
+	Lockout caddy.Duration `json:"lockout,omitempty"`
+
+	// Longest lockout. Default: 1h.
+	MaxLockout caddy.Duration `json:"max_lockout,omitempty"`
+
+	// Delay before answering failed attempts and locked out clients. Not applied with probe resistance,
+	// as the web server it mimics would answer right away. Default: 0.
+	Tarpit caddy.Duration `json:"tarpit,omitempty"`
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry // keyed by "ip:<address>" and "user:<username>"
+	nextSweep int
+}
+
+type lockoutEntry struct {
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockedOutError is returned for a locked out client, whatever its credentials.
+type lockedOutError struct {
+	until time.Time
+}
+
+func (e *lockedOutError) Error() string {
+	return fmt.Sprintf("too many failed authentication attempts, locked out until %s", e.until.Format(time.RFC3339))
+}
+
+func (l *AuthLockout) provision() error {
+	if l.MaxFailures == 0 {
+		l.MaxFailures = 5
+	}
+	if l.Lockout == 0 {
+		l.Lockout = caddy.Duration(time.Minute)
+	}
+	if l.MaxLockout == 0 {
+		l.MaxLockout = caddy.Duration(time.Hour)
+	}
+	if l.MaxFailures < 0 || l.Lockout < 0 || l.Tarpit < 0 || l.MaxLockout < l.Lockout {
+		return errors.New("limits must be positive, and max_lockout must not be shorter than lockout")
+	}
+	l.entries = make(map[string]*lockoutEntry)
+	return nil
+}
+
+// lockedUntil returns when the lockout of any of keys ends, or the zero time if none of them is locked out.
+func (l *AuthLockout) lockedUntil(keys []string, now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var until time.Time
+	for _, key := range keys {
+		if entry := l.entries[key]; entry != nil && now.Before(entry.lockedUntil) && entry.lockedUntil.After(until) {
+			until = entry.lockedUntil
+		}
+	}
+	return until
+}
+
+func (l *AuthLockout) failed(keys []string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maxLockout := time.Duration(l.MaxLockout)
+	if len(l.entries) >= l.nextSweep {
+		for key, entry := range l.entries {
+			if now.Sub(entry.lastFailure) > maxLockout && !now.Before(entry.lockedUntil) {
+				delete(l.entries, key)
+			}
+		}
+		l.nextSweep = 2*len(l.entries) + 64
+	}
+	for _, key := range keys {
+		entry := l.entries[key]
+		if entry == nil || now.Sub(entry.lastFailure) > maxLockout {
+			entry = &lockoutEntry{}
+			l.entries[key] = entry
+		}
+		entry.lastFailure = now
+		if entry.failures++; entry.failures < l.MaxFailures {
+			continue
+		}
+		lockout := time.Duration(l.Lockout) << entry.lockouts
+		if lockout > maxLockout || lockout <= 0 { // also catches overflows
+			lockout = maxLockout
+		}
+		entry.failures = 0
+		entry.lockouts++
+		entry.lockedUntil = now.Add(lockout)
+	}
+}
+
+func (l *AuthLockout) succeeded(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+// tarpit waits for the configured delay, or until ctx is done.
+func (l *AuthLockout) tarpit(ctx context.Context) {
+	if l.Tarpit <= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(l.Tarpit))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// lockoutKeys returns the counters that an authentication attempt of r counts against.
+func lockoutKeys(r *http.Request) []string {
+	keys := []string{"ip:" + remoteIP(r)}
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if decoded, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+			if user, _, ok := strings.Cut(string(decoded), ":"); ok {
+				keys = append(keys, "user:"+user)
+			}
+		}
+	case "digest":
+		if params, err := parseAuthParams(credentials); err == nil && len(params["username"]) > 0 {
+			keys = append(keys, "user:"+params["username"])
+		}
+	}
+	return keys
+}
+
+// remoteIP returns the IP address of the client that sent r.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// authenticate is checkCredentials, subject to the lockout policy if there is one.
+func (h Handler) authenticate(r *http.Request) error {
+	if h.AuthLockout == nil {
+		return h.checkCredentials(r)
+	}
+	keys := lockoutKeys(r)
+	now := time.Now()
+	var err error
+	if until := h.AuthLockout.lockedUntil(keys, now); !until.IsZero() {
+		if h.ProbeResistance != nil {
+			// take as long as any other request, so that the lockout cannot be told apart by timing
+			_ = h.checkCredentials(r)
+		}
+		err = &lockedOutError{until: until}
+	} else if err = h.checkCredentials(r); err == nil {
+		h.AuthLockout.succeeded(keys)
+		return nil
+	} else if errors.As(err, new(digestStaleError)) {
+		// the credentials were correct, and the client retries them with a fresh nonce
+		return err
+	} else if errors.As(err, new(forwardAuthError)) {
+		// auth_url is down or misbehaving, which is not the client's fault
+		return err
+	} else if len(r.Header.Get("Proxy-Authorization")) > 0 {
+		h.AuthLockout.failed(keys, now)
+	}
+	if h.ProbeResistance == nil && len(r.Header.Get("Proxy-Authorization")) > 0 {
+		h.AuthLockout.tarpit(r.Context())
+	}
+	return err
+}
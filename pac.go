@@ -0,0 +1,274 @@
+package forwardproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// PACConfig describes the Proxy Auto-Config file served at PACPath. Destinations are decided in this order:
+// localhost and Bypass go direct, then anything not in Only (if set) goes direct, then the ACL is followed
+// (if UseACL is set), and everything else goes through Proxies.
+type PACConfig struct {
+	// Proxies to try in order, in PAC syntax: "HTTPS <host:port>", "PROXY <host:port>" (plain HTTP, for clients
+	// that cannot use HTTPS proxies), "SOCKS5 <host:port>" or "DIRECT". They may contain placeholders, such as
+	// {http.request.hostport}, the host and port of the request for the PAC file.
+	// Default: HTTPS {http.request.hostport}.
+	Proxies []string `json:"proxies,omitempty"`
+
+	// Destinations to connect to directly, as in ACL subjects: domains (with *. for subdomains), IP addresses
+	// and CIDR ranges.
+	Bypass []string `json:"bypass,omitempty"`
+
+	// If set, only these destinations (as in Bypass) go through the proxy.
+	Only []string `json:"only,omitempty"`
+
+	// If true, destinations that the domain and IPv4 rules of the ACL deny go direct, as the proxy would refuse them.
+	// Clients cannot evaluate other rules (categories, GeoIP and IPv6), so the ACL is followed up to the first of them,
+	// and everything else goes through Proxies. The default denial of private addresses is left out.
+	UseACL bool `json:"use_acl,omitempty"`
+
+	// If set, every user of basic_auth, auth_users, auth_file and digest_auth gets their own PAC file at
+	// UserPath<token>.pac, with a token derived from their username, so that there is no predictable path
+	// to find the proxy with. Requests with unknown tokens are passed to the next handler.
+	// Proxies may contain the username as {http.forward_proxy.pac_user}. The PAC files of users only differ in
+	// the proxies, so the rest of the file is the same for everyone.
+	UserPath string `json:"user_path,omitempty"`
+
+	// Key that tokens are derived with, with HMAC-SHA256. Changing it changes the PAC URLs of all users.
+	UserSecret string `json:"user_secret,omitempty"`
+
+	// Hosts that answer Web Proxy Auto-Discovery (WPAD) requests for /wpad.dat with the PAC file,
+	// e.g. wpad.example.lan. Browsers look for them on the local network, so only clients with private, loopback
+	// or link-local IP addresses are answered. Requires Proxies, and cannot be used with probe resistance.
+	WPADHosts caddyhttp.MatchHost `json:"wpad_hosts,omitempty"`
+
+	script string                            // with pacProxiesMarker where the proxies go
+	users  atomic.Pointer[map[string]string] // by token, from loadUsers
+}
+
+// pacProxiesMarker stands for the proxies in the script of a PACConfig, which depend on the request.
+const pacProxiesMarker = "\x00"
+
+// pacProxyTypes are the types of proxies in PAC files that have an address.
+var pacProxyTypes = map[string]bool{"PROXY": true, "HTTP": true, "HTTPS": true, "SOCKS": true, "SOCKS4": true, "SOCKS5": true}
+
+func (p *PACConfig) provision(ctx caddy.Context, aclRules []aclRule) error {
+	if len(p.WPADHosts) > 0 && len(p.Proxies) == 0 {
+		// the default would point clients to the WPAD host, which cannot have a trusted certificate
+		return errors.New("wpad_hosts require proxies")
+	}
+	if len(p.Proxies) == 0 {
+		p.Proxies = []string{"HTTPS {http.request.hostport}"}
+	}
+	for _, proxy := range p.Proxies {
+		kind, address, _ := strings.Cut(proxy, " ")
+		if kind == "DIRECT" && len(address) == 0 || pacProxyTypes[kind] && len(strings.TrimSpace(address)) > 0 {
+			continue
+		}
+		return fmt.Errorf("invalid proxy: %q", proxy)
+	}
+	if len(p.UserPath) > 0 {
+		if !strings.HasPrefix(p.UserPath, "/") || !strings.HasSuffix(p.UserPath, "/") {
+			return fmt.Errorf("user_path must start and end with /, got: %s", p.UserPath)
+		}
+		if len(p.UserSecret) == 0 {
+			return errors.New("user_path requires user_secret")
+		}
+	}
+	if err := p.WPADHosts.Provision(ctx); err != nil {
+		return fmt.Errorf("bad wpad_hosts: %v", err)
+	}
+	bypass, err := pacConditions(p.Bypass)
+	if err != nil {
+		return fmt.Errorf("bad bypass: %v", err)
+	}
+	only, err := pacConditions(p.Only)
+	if err != nil {
+		return fmt.Errorf("bad only: %v", err)
+	}
+
+	var body strings.Builder
+	body.WriteString(`	if (host === "127.0.0.1" || host === "::1" || host === "localhost")
+		return "DIRECT";
+`)
+	if len(bypass) > 0 {
+		fmt.Fprintf(&body, "\tif (%s)\n\t\treturn \"DIRECT\";\n", strings.Join(bypass, " || "))
+	}
+	if len(only) > 0 {
+		fmt.Fprintf(&body, "\tif (!(%s))\n\t\treturn \"DIRECT\";\n", strings.Join(only, " || "))
+	}
+	terminated := false
+	if p.UseACL {
+		for _, rule := range aclRules {
+			condition, allow, ok := pacCondition(rule)
+			if !ok {
+				break // the rest depends on what the client cannot tell, so let the proxy decide
+			}
+			result := `"DIRECT"`
+			if allow {
+				result = pacProxiesMarker
+			}
+			if _, all := rule.(*aclAllRule); all {
+				fmt.Fprintf(&body, "\treturn %s;\n", result)
+				terminated = true
+				break
+			}
+			fmt.Fprintf(&body, "\tif (%s)\n\t\treturn %s;\n", condition, result)
+		}
+	}
+	if !terminated {
+		body.WriteString("\treturn " + pacProxiesMarker + ";\n")
+	}
+
+	var script strings.Builder
+	script.WriteString("\nfunction FindProxyForURL(url, host) {\n")
+	if strings.Contains(body.String(), "ip()") {
+		script.WriteString(`	var address = null;
+	function ip() {
+		if (address === null)
+			address = dnsResolve(host) || "";
+		return address;
+	}
+`)
+	}
+	script.WriteString(body.String())
+	script.WriteString("}\n")
+	p.script = script.String()
+	return nil
+}
+
+// pacConditions parses destinations into JavaScript conditions for FindProxyForURL.
+func pacConditions(subjects []string) ([]string, error) {
+	conditions := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		rule, err := newACLRule(subject, "", true, aclDatabases{})
+		if err != nil {
+			return nil, err
+		}
+		condition, _, ok := pacCondition(rule)
+		if _, all := rule.(*aclAllRule); !ok || all {
+			return nil, fmt.Errorf("%s: expected a domain, an IPv4 address or an IPv4 CIDR range", subject)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// pacCondition returns a JavaScript condition that is true in FindProxyForURL for the destinations that rule matches,
+// and whether rule allows them, or false if clients cannot evaluate rule.
+func pacCondition(rule aclRule) (condition string, allow bool, ok bool) {
+	switch rule := rule.(type) {
+	case *aclDomainRule:
+		condition = "host === " + jsString(rule.domain)
+		if rule.subdomainsAllowed {
+			condition += " || dnsDomainIs(host, " + jsString("."+rule.domain) + ")"
+		}
+		return condition, rule.allow, true
+	case *aclIPRule:
+		// dnsResolve only returns IPv4 addresses
+		if ip := rule.net.IP.To4(); ip != nil && len(rule.net.Mask) == net.IPv4len {
+			return fmt.Sprintf("isInNet(ip(), %s, %s)", jsString(ip.String()), jsString(net.IP(rule.net.Mask).String())),
+				rule.allow, true
+		}
+	case *aclAllRule:
+		return "true", rule.allow, true
+	}
+	return "", false, false
+}
+
+// jsString returns s as a JavaScript string literal.
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// generate returns the PAC file, with the placeholders of Proxies replaced with repl.
+func (p *PACConfig) generate(repl *caddy.Replacer) string {
+	proxies := make([]string, len(p.Proxies))
+	for i, proxy := range p.Proxies {
+		proxies[i] = repl.ReplaceKnown(proxy, "")
+	}
+	return strings.ReplaceAll(p.script, pacProxiesMarker, jsString(strings.Join(proxies, "; ")))
+}
+
+// userToken returns the token in the URL of the PAC file of user.
+func (p *PACConfig) userToken(user string) string {
+	mac := hmac.New(sha256.New, []byte(p.UserSecret))
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// pacUsers returns the users that can have their own PAC file: those whose usernames are known in advance.
+func (h Handler) pacUsers() []string {
+	var users []string
+	for _, creds := range h.AuthCredentials {
+		if decoded, err := base64.StdEncoding.DecodeString(string(creds)); err == nil {
+			user, _, _ := strings.Cut(string(decoded), ":")
+			users = append(users, user)
+		}
+	}
+	if h.passwordHashes != nil {
+		users = append(users, h.passwordHashes.usernames()...)
+	}
+	for _, realm := range h.DigestAuth {
+		for _, user := range realm.Users {
+			users = append(users, user.Username)
+		}
+	}
+	return users
+}
+
+// loadUsers computes the tokens of users, replacing those of previous calls.
+func (p *PACConfig) loadUsers(users []string) {
+	tokens := make(map[string]string, len(users))
+	for _, user := range users {
+		tokens[p.userToken(user)] = user
+	}
+	p.users.Store(&tokens)
+}
+
+// pacUser returns the user whose PAC file is at path, if any.
+func (h Handler) pacUser(path string) (string, bool) {
+	if h.PAC == nil || len(h.PAC.UserPath) == 0 || h.PAC.users.Load() == nil {
+		return "", false
+	}
+	token, ok := strings.CutPrefix(path, h.PAC.UserPath)
+	if !ok {
+		return "", false
+	}
+	if token, ok = strings.CutSuffix(token, ".pac"); !ok || len(token) == 0 {
+		return "", false
+	}
+	user, ok := (*h.PAC.users.Load())[token]
+	return user, ok
+}
+
+// pacURL returns the URL of the PAC file for the client of r, authenticated as user (if any), or "" if there is none.
+func (h Handler) pacURL(r *http.Request, user string) string {
+	path := h.PACPath
+	if len(user) > 0 && h.PAC != nil && len(h.PAC.UserPath) > 0 && h.PAC.users.Load() != nil {
+		if token := h.PAC.userToken(user); (*h.PAC.users.Load())[token] == user {
+			path = h.PAC.UserPath + token + ".pac"
+		}
+	}
+	if len(path) == 0 {
+		return ""
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
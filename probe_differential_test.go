@@ -0,0 +1,131 @@
+package forwardproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawProbe sends request to addr over TLS, and returns the raw bytes of the response, followed by whether the
+// server closed the connection after it.
+func rawProbe(addr, request string) ([]byte, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, request); err != nil {
+		return nil, err
+	}
+	var response bytes.Buffer
+	buf := make([]byte, 4096)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, err := conn.Read(buf)
+		response.Write(buf[:n])
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			response.WriteString("\n[connection kept open]")
+			return response.Bytes(), nil
+		}
+		if err != nil {
+			response.WriteString("\n[connection closed]")
+			return response.Bytes(), nil
+		}
+	}
+}
+
+var (
+	probeDateHeader   = regexp.MustCompile(`(?m)^Date: .*\r\n`)
+	probeAltSvcHeader = regexp.MustCompile(`(?m)^Alt-Svc: .*\r\n`)
+)
+
+// normalizeProbeResponse removes what legitimately differs between two servers: the date, and their addresses.
+func normalizeProbeResponse(response []byte) string {
+	response = probeDateHeader.ReplaceAll(response, nil)
+	response = probeAltSvcHeader.ReplaceAll(response, []byte("Alt-Svc: #\r\n"))
+	return string(removeAddressesByte(response))
+}
+
+// TestProbeResistDifferential sends probes that an unauthenticated client could send to a server with
+// probe resistance, and to the same server without forward proxy, and expects byte-for-byte identical responses.
+func TestProbeResistDifferential(t *testing.T) {
+	target := caddyTestTarget.addr
+	probes := map[string]string{
+		"connect without credentials": "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+		"connect with wrong basic":    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+		"connect with bad base64":     "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Basic !!!\r\n\r\n",
+		"connect with empty basic":    "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Basic\r\n\r\n",
+		"connect with digest":         "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Digest username=\"test\", response=\"00\"\r\n\r\n",
+		"connect with bearer":         "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Bearer a.b.c\r\n\r\n",
+		"connect over HTTP/1.0":       "CONNECT " + target + " HTTP/1.0\r\n\r\n",
+		"connect to self":             "CONNECT {self} HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"absolute get":                "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+		"absolute get with wrong creds": "GET http://" + target + "/pic.png HTTP/1.1\r\nHost: " + target +
+			"\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+		"absolute post":         "POST http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\nContent-Length: 4\r\n\r\ntest",
+		"get self":              "GET / HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"get self with creds":   "GET / HTTP/1.1\r\nHost: {self}\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+		"options asterisk":      "OPTIONS * HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"unknown method":        "FOO / HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"get closing":           "GET /index.html HTTP/1.1\r\nHost: {self}\r\nConnection: close\r\n\r\n",
+		"malformed credentials": "GET / HTTP/1.1\r\nHost: {self}\r\nProxy-Authorization: garbage\r\n\r\n",
+		"absolute get with malformed credentials": "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target +
+			"\r\nProxy-Authorization: Basic\r\n\r\n",
+		"connect with malformed credentials": "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: garbage\r\n\r\n",
+		"connect to unknown domain":          "CONNECT wrong.localhost:443 HTTP/1.1\r\nHost: wrong.localhost:443\r\n\r\n",
+		"head self":                          "HEAD / HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"head self with creds":               "HEAD / HTTP/1.1\r\nHost: {self}\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+		"absolute head":                      "HEAD http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+		"options self":                       "OPTIONS / HTTP/1.1\r\nHost: {self}\r\n\r\n",
+		"absolute options":                   "OPTIONS http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+		"absolute options with creds": "OPTIONS http://" + target + "/ HTTP/1.1\r\nHost: " + target +
+			"\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+	}
+	for name, probe := range probes {
+		responses := make([]string, 2)
+		for i, addr := range []string{caddyForwardProxyProbeResist.addr, caddyDummyProbeResist.addr} {
+			response, err := rawProbe(addr, strings.ReplaceAll(probe, "{self}", addr))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			responses[i] = normalizeProbeResponse(response)
+		}
+		if responses[0] != responses[1] {
+			t.Errorf("%s: responses differ.\nWith probe resistance:\n%s\nWithout forward proxy:\n%s", name, responses[0], responses[1])
+		}
+	}
+}
+
+// TestProbeResistSecretDomain checks that the secret domain is what gives the proxy away: requests for it get 407,
+// whether they are CONNECT or not, and with wrong credentials as without.
+func TestProbeResistSecretDomain(t *testing.T) {
+	const secret = "test.localhost"
+	var expected string
+	for name, probe := range map[string]string{
+		"get":                      "GET / HTTP/1.1\r\nHost: " + secret + "\r\n\r\n",
+		"connect":                  "CONNECT " + secret + ":443 HTTP/1.1\r\nHost: " + secret + ":443\r\n\r\n",
+		"connect with wrong basic": "CONNECT " + secret + ":443 HTTP/1.1\r\nHost: " + secret + ":443\r\nProxy-Authorization: Basic dGVzdDp3cm9uZw==\r\n\r\n",
+		"connect with malformed credentials": "CONNECT " + secret + ":443 HTTP/1.1\r\nHost: " + secret +
+			":443\r\nProxy-Authorization: garbage\r\n\r\n",
+	} {
+		response, err := rawProbe(caddyForwardProxyProbeResist.addr, probe)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		normalized := normalizeProbeResponse(response)
+		if !strings.HasPrefix(normalized, "HTTP/1.1 407 ") {
+			t.Errorf("%s: expected 407, got:\n%s", name, normalized)
+		}
+		if len(expected) == 0 {
+			expected = normalized
+		} else if normalized != expected {
+			t.Errorf("%s: responses differ:\n%s\n%s", name, normalized, expected)
+		}
+	}
+}
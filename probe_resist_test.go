@@ -2,13 +2,23 @@ package forwardproxy
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGETAuthCorrectProbeResist(t *testing.T) {
@@ -446,3 +456,263 @@ func changePort(inputAddr, toPort string) string {
 	}
 	return net.JoinHostPort(host, toPort)
 }
+
+// TestProbeResistTiming checks that with auth_padding, failed authentication takes as long as successful
+// authentication followed by a dial, on a fake clock, and that visitors of the website are not delayed.
+func TestProbeResistTiming(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth alice pass
+		probe_resistance {
+			auth_padding 50ms
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+	h.ProbeResistance.clock = func() time.Time { return now }
+	h.ProbeResistance.sleep = func(_ context.Context, d time.Duration) { now = now.Add(d) }
+	var dialTime time.Duration
+	var dialed bool
+	h.dialContext = func(context.Context, string, string, net.Addr) (net.Conn, error) {
+		dialed = true
+		now = now.Add(dialTime)
+		return nil, errors.New("unreachable")
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	elapsed := func(r *http.Request) time.Duration {
+		start := now
+		_ = h.ServeHTTP(httptest.NewRecorder(), r, next)
+		return now.Sub(start)
+	}
+	connect := func(authorization string) *http.Request {
+		r, _ := newAuthRequest(authorization)
+		r.URL.Host = "203.0.113.1:443"
+		return r
+	}
+	correct := "Basic " + string(EncodeAuthCredentials("alice", "pass"))
+	wrong := "Basic " + string(EncodeAuthCredentials("alice", "wrong"))
+
+	for _, dialTime = range []time.Duration{0, 20 * time.Millisecond} {
+		dialed = false
+		if d := elapsed(connect(correct)); d != 50*time.Millisecond || !dialed {
+			t.Errorf("Expected a dial taking %v to be padded to 50ms, got %v", dialTime, d)
+		}
+		dialed = false
+		if d := elapsed(connect(wrong)); d != 50*time.Millisecond || dialed {
+			t.Errorf("Expected failed authentication to be padded to 50ms, got %v", d)
+		}
+		if d := elapsed(connect("")); d != 50*time.Millisecond {
+			t.Errorf("Expected requests without credentials to be padded to 50ms, got %v", d)
+		}
+	}
+	// dials longer than the padding cannot be hidden
+	dialTime = 80 * time.Millisecond
+	if d := elapsed(connect(correct)); d != dialTime {
+		t.Errorf("Expected a dial taking %v not to be padded, got %v", dialTime, d)
+	}
+
+	site, _ := http.NewRequest(http.MethodGet, "/", nil)
+	site = site.WithContext(context.WithValue(site.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if d := elapsed(site); d != 0 {
+		t.Errorf("Expected visitors of the website not to be delayed, got %v", d)
+	}
+	site.Header.Set("Proxy-Authorization", wrong)
+	if d := elapsed(site); d != 50*time.Millisecond {
+		t.Errorf("Expected requests with credentials to be padded to 50ms, got %v", d)
+	}
+}
+
+func TestProbeResistTimingMeasured(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures real response times")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const padding, jitter = 50 * time.Millisecond, 10 * time.Millisecond
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		authentication http_basic bcrypt {
+			alice ` + base64.StdEncoding.EncodeToString(hash) + `
+		}
+		probe_resistance {
+			auth_padding ` + padding.String() + `
+			auth_jitter ` + jitter.String() + `
+		}
+	}`)
+	if err = h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err = h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	elapsed := func(authorization string) time.Duration {
+		r, _ := newAuthRequest(authorization)
+		start := time.Now()
+		_ = h.ServeHTTP(httptest.NewRecorder(), r, next)
+		return time.Since(start)
+	}
+
+	const samples = 30
+	var wrong, none []time.Duration
+	for i := 0; i < samples; i++ {
+		wrong = append(wrong, elapsed("Basic "+string(EncodeAuthCredentials("alice", "wrong"))))
+		none = append(none, elapsed(""))
+	}
+	sort.Slice(wrong, func(i, j int) bool { return wrong[i] < wrong[j] })
+	sort.Slice(none, func(i, j int) bool { return none[i] < none[j] })
+	for _, durations := range [][]time.Duration{wrong, none} {
+		// leave some room for the scheduler
+		if durations[0] < padding || durations[samples-1] > padding+jitter+20*time.Millisecond {
+			t.Fatalf("Expected responses to take %v plus up to %v, got %v to %v",
+				padding, jitter, durations[0], durations[samples-1])
+		}
+	}
+	if wrong[0] > none[samples-1] || none[0] > wrong[samples-1] {
+		t.Fatalf("Expected response times to overlap, got %v to %v with wrong credentials and %v to %v without",
+			wrong[0], wrong[samples-1], none[0], none[samples-1])
+	}
+	if diff := wrong[samples/2] - none[samples/2]; diff < -jitter/2 || diff > jitter/2 {
+		t.Fatalf("Expected median response times to be within %v, got %v apart", jitter/2, diff)
+	}
+}
+
+func TestHiddenPage(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth frank pass
+		serve_pac /secret.pac
+		user_quota {
+			daily 1MB
+		}
+		probe_resistance secret.localhost {
+			page {
+				status 202
+				header Content-Type text/plain
+				header X-User {http.auth.user.id}
+				body "{http.auth.user.id}: {http.forward_proxy.pac_url} {http.forward_proxy.quota.daily_bytes}/{http.forward_proxy.quota.daily_limit}"
+			}
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	h.UserQuota.transferred("frank", 1234, time.Now())
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://secret.localhost/", nil)
+		if len(authorization) > 0 {
+			r.Header.Set("Proxy-Authorization", authorization)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+		w := httptest.NewRecorder()
+		_ = h.ServeHTTP(w, r, nil)
+		return w
+	}
+	w := serve("Basic " + string(EncodeAuthCredentials("frank", "pass")))
+	if w.Code != http.StatusAccepted || w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-User") != "frank" {
+		t.Fatalf("Unexpected response: %d %v", w.Code, w.Header())
+	}
+	if body := w.Body.String(); body != "frank: https://secret.localhost/secret.pac 1234/1000000" {
+		t.Fatal("Unexpected body:", body)
+	}
+	if w = serve(""); w.Code != http.StatusProxyAuthRequired || strings.Contains(w.Body.String(), "frank") {
+		t.Fatalf("Expected unauthenticated clients to be asked for credentials, got: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, status := range []int{101, 199, 600, 999} {
+		page := HiddenPage{Status: status}
+		if err := page.provision(); err == nil {
+			t.Errorf("Expected status %d to be rejected", status)
+		}
+	}
+}
+
+func TestProbeResistKnock(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth grace pass
+		probe_resistance {
+			knock /open /sesame
+			unlock_duration 1m
+			knock_timeout 10s
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	p := h.ProbeResistance
+	now := time.Now()
+	for _, c := range []struct {
+		ip, path string
+		after    time.Duration
+		unlocked bool
+	}{
+		{"192.0.2.1", "/sesame", 0, false},                // out of order
+		{"192.0.2.1", "/open", 0, false},                  // first knock
+		{"192.0.2.1", "/favicon.ico", 0, false},           // unrelated paths do not matter
+		{"192.0.2.1", "/sesame", 0, true},                 // second knock
+		{"192.0.2.2", "/open", 0, false},                  // others are still locked
+		{"192.0.2.2", "/open", 0, false},                  // knocking the first path again restarts the sequence
+		{"192.0.2.2", "/sesame", 11 * time.Second, false}, // too late
+		{"192.0.2.3", "/open", 0, false},
+		{"192.0.2.3", "/open/", 0, false},
+		{"192.0.2.3", "/sesame", 0, true},
+		{"192.0.2.3", "/open", 0, true},        // knocking again does not lock it
+		{"192.0.2.1", "/", time.Minute, false}, // unlock expired
+	} {
+		now = now.Add(c.after)
+		p.knock(c.ip, c.path, now)
+		if unlocked := p.unlocked(c.ip, now); unlocked != c.unlocked {
+			t.Fatalf("%s after knocking %s: expected unlocked to be %v", c.ip, c.path, c.unlocked)
+		}
+	}
+
+	var passed bool
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		passed = true
+		return nil
+	})
+	serve := func(method, target string) error {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "198.51.100.1:1234"
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+		passed = false
+		return h.ServeHTTP(httptest.NewRecorder(), r, next)
+	}
+	if err := serve(http.MethodConnect, "example.com:443"); err != nil || !passed {
+		t.Fatal("Expected locked clients to be passed to the next handler, got:", err)
+	}
+	for _, target := range []string{"http://example.com/open", "http://example.com/sesame"} { // proxy requests are not knocks
+		if err := serve(http.MethodGet, target); err != nil || !passed {
+			t.Fatal("Expected proxy requests of locked clients to be passed to the next handler, got:", err)
+		}
+	}
+	if err := serve(http.MethodConnect, "example.com:443"); err != nil || !passed {
+		t.Fatal("Expected proxy requests not to unlock the proxy, got:", err)
+	}
+	for _, path := range []string{"/open", "/sesame"} { // the proxy is only unlocked for the requests after the knocks
+		if err := serve(http.MethodGet, path); err != nil || !passed {
+			t.Fatal("Expected knocks to be passed to the next handler, got:", err)
+		}
+	}
+	var handlerErr caddyhttp.HandlerError
+	if err := serve(http.MethodConnect, "example.com:443"); passed || !errors.As(err, &handlerErr) ||
+		handlerErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatal("Expected unlocked clients to be asked for credentials, got:", err)
+	}
+}
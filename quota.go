@@ -0,0 +1,306 @@
+package forwardproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// UserQuota limits what each authenticated user (by http.auth.user.id) can use of the proxy.
+// Zero values mean no limit. Days and months are in UTC.
+type UserQuota struct {
+	// Concurrent CONNECT tunnels per user.
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+
+	// Bandwidth per user in bits per second, in both directions combined, shared by all their tunnels
+	// and plain HTTP requests. Users over it are throttled.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+
+	// Bytes per user per day and per month, in both directions combined. Once a user is over one of them,
+	// new tunnels and requests are rejected until the next day or month, while existing ones carry on.
+	DailyBytes   int64 `json:"daily_bytes,omitempty"`
+	MonthlyBytes int64 `json:"monthly_bytes,omitempty"`
+
+	// File to keep the daily and monthly usage in, so that it survives restarts. It is written every
+	// SaveInterval, and when the handler is stopped.
+	StateFile string `json:"state_file,omitempty"`
+
+	// Default: 1m.
+	SaveInterval caddy.Duration `json:"save_interval,omitempty"`
+
+	state       *quotaState
+	bandwidthMu sync.Mutex
+	bandwidths  map[string]*tokenBucket // by user
+	nextSweep   int
+}
+
+// quotaStates shares the usage of users between the handlers using the same StateFile, including those of
+// the previous config while the config is reloaded. The usage is saved when the last of them is cleaned up.
+var quotaStates = caddy.NewUsagePool()
+
+type quotaState struct {
+	path   string // "" if not persisted
+	mu     sync.Mutex
+	users  map[string]*userUsage
+	saveMu sync.Mutex
+}
+
+// userUsage is the usage of a user. The exported fields are persisted in StateFile.
+type userUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+
+	tunnels int
+}
+
+// quotaExceededError is returned for tunnels and requests of a user over their quota.
+type quotaExceededError struct {
+	msg        string
+	retryAfter time.Duration // 0 if unknown
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.msg
+}
+
+func (q *UserQuota) provision(ctx caddy.Context, logger *zap.Logger) error {
+	if q.MaxTunnels < 0 || q.Bandwidth < 0 || q.DailyBytes < 0 || q.MonthlyBytes < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	if q.SaveInterval <= 0 {
+		q.SaveInterval = caddy.Duration(time.Minute)
+	}
+	if len(q.StateFile) == 0 {
+		q.state = &quotaState{users: make(map[string]*userUsage)}
+		return nil
+	}
+	state, _, err := quotaStates.LoadOrNew(q.StateFile, func() (caddy.Destructor, error) {
+		return loadQuotaState(q.StateFile)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load quota state: %v", err)
+	}
+	q.state = state.(*quotaState)
+	go func() {
+		ticker := time.NewTicker(time.Duration(q.SaveInterval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.state.save(); err != nil {
+					logger.Error("failed to save quota state", zap.String("path", q.StateFile), zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *UserQuota) cleanup() error {
+	if q.state == nil || len(q.state.path) == 0 { // not provisioned, or not shared
+		return nil
+	}
+	_, err := quotaStates.Delete(q.StateFile)
+	return err
+}
+
+func loadQuotaState(path string) (*quotaState, error) {
+	s := &quotaState{path: path, users: make(map[string]*userUsage)}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &s.users)
+	}
+	return s, err
+}
+
+// save writes the usage of all users to the state file, replacing it atomically.
+func (s *quotaState) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	data, err := json.Marshal(s.users)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Destruct saves the usage when the state is no longer used.
+func (s *quotaState) Destruct() error {
+	return s.save()
+}
+
+// usage returns the usage of user in the current day and month. q.state.mu must be held.
+func (q *UserQuota) usage(user string, now time.Time) *userUsage {
+	u := q.state.users[user]
+	if u == nil {
+		u = &userUsage{}
+		q.state.users[user] = u
+	}
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+	return u
+}
+
+// snapshot returns a copy of the usage of user in the current day and month.
+func (q *UserQuota) snapshot(user string, now time.Time) userUsage {
+	q.state.mu.Lock()
+	defer q.state.mu.Unlock()
+	return *q.usage(user, now)
+}
+
+// acquire admits a new tunnel (if tunnel is set) or plain HTTP request of user. release must be called when it ends.
+func (q *UserQuota) acquire(user string, tunnel bool, now time.Time) (release func(), err error) {
+	q.state.mu.Lock()
+	defer q.state.mu.Unlock()
+	u := q.usage(user, now)
+	utc := now.UTC()
+	if q.DailyBytes > 0 && u.DayBytes >= q.DailyBytes {
+		tomorrow := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		return nil, &quotaExceededError{"daily traffic quota exceeded by " + user, tomorrow.Sub(utc)}
+	}
+	if q.MonthlyBytes > 0 && u.MonthBytes >= q.MonthlyBytes {
+		nextMonth := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return nil, &quotaExceededError{"monthly traffic quota exceeded by " + user, nextMonth.Sub(utc)}
+	}
+	if !tunnel {
+		return func() {}, nil
+	}
+	if q.MaxTunnels > 0 && u.tunnels >= q.MaxTunnels {
+		return nil, &quotaExceededError{msg: "too many concurrent tunnels of " + user}
+	}
+	u.tunnels++
+	return func() {
+		q.state.mu.Lock()
+		defer q.state.mu.Unlock()
+		u.tunnels--
+	}, nil
+}
+
+// transferred accounts n bytes to user, and returns how long to wait to stay within their bandwidth.
+func (q *UserQuota) transferred(user string, n int, now time.Time) time.Duration {
+	q.state.mu.Lock()
+	u := q.usage(user, now)
+	u.DayBytes += int64(n)
+	u.MonthBytes += int64(n)
+	q.state.mu.Unlock()
+	if q.Bandwidth <= 0 {
+		return 0
+	}
+	q.bandwidthMu.Lock()
+	bucket := q.bandwidths[user]
+	if bucket == nil {
+		if len(q.bandwidths) >= q.nextSweep {
+			// buckets that refilled are as good as new, and those of users that are still throttled are kept
+			for k, b := range q.bandwidths {
+				if b.full(now) {
+					delete(q.bandwidths, k)
+				}
+			}
+			q.nextSweep = 2*len(q.bandwidths) + 1024
+		}
+		if q.bandwidths == nil {
+			q.bandwidths = make(map[string]*tokenBucket)
+		}
+		bytesPerSecond := float64(q.Bandwidth) / 8
+		bucket = newTokenBucket(bytesPerSecond, max(bytesPerSecond, 32*1024), now)
+		q.bandwidths[user] = bucket
+	}
+	q.bandwidthMu.Unlock()
+	return bucket.take(float64(n), now)
+}
+
+// account counts n bytes transferred by user, throttling the caller as needed.
+func (q *UserQuota) account(ctx context.Context, user string, n int) {
+	if n <= 0 {
+		return
+	}
+	if wait := q.transferred(user, n, time.Now()); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// quotaConn accounts traffic through a connection to the target to a user.
+type quotaConn struct {
+	net.Conn
+	ctx   context.Context
+	quota *UserQuota
+	user  string
+}
+
+func (c quotaConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.quota.account(c.ctx, c.user, n)
+	return n, err
+}
+
+func (c quotaConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.quota.account(c.ctx, c.user, n)
+	return n, err
+}
+
+// CloseWrite keeps half-closing the tunnel working.
+func (c quotaConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// quotaReadCloser accounts a request or response body to a user.
+type quotaReadCloser struct {
+	io.ReadCloser
+	ctx   context.Context
+	quota *UserQuota
+	user  string
+}
+
+func (r quotaReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.quota.account(r.ctx, r.user, n)
+	return n, err
+}
+
+// quotaUser returns the authenticated user that the usage of r is accounted to, or "" if there is none.
+func (h Handler) quotaUser(r *http.Request) string {
+	if h.UserQuota == nil || !h.authEnabled() {
+		return ""
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	user, _ := repl.GetString("http.auth.user.id")
+	return user
+}
@@ -0,0 +1,132 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestUserQuota(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		basic_auth alice pass
+		user_quota {
+			max_tunnels 2
+			bandwidth 80kbit
+			daily 1MB
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if h.UserQuota.Bandwidth != 80000 || h.UserQuota.DailyBytes != 1000000 {
+		t.Fatalf("Unexpected limits: %+v", h.UserQuota)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	q := h.UserQuota
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	release1, err := q.acquire("alice", true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.acquire("alice", true, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.acquire("alice", true, now); err == nil {
+		t.Fatal("Expected a third tunnel to be rejected")
+	}
+	if _, err = q.acquire("bob", true, now); err != nil {
+		t.Fatal("Expected tunnels to be limited per user, got:", err)
+	}
+	if _, err = q.acquire("alice", false, now); err != nil {
+		t.Fatal("Expected plain HTTP requests not to count as tunnels, got:", err)
+	}
+	release1()
+	if _, err = q.acquire("alice", true, now); err != nil {
+		t.Fatal("Expected a released tunnel to make room, got:", err)
+	}
+
+	// 10000 bytes per second, with a burst of 32KiB
+	if wait := q.transferred("alice", 32*1024, now); wait != 0 {
+		t.Fatal("Expected the burst to go through, got a wait of", wait)
+	}
+	if wait := q.transferred("alice", 10000, now); wait != time.Second {
+		t.Fatal("Expected a wait of 1s, got", wait)
+	}
+	// buckets of idle users are dropped once there are many, unlike those of users still throttled
+	for i := 0; i < 2000; i++ {
+		q.transferred(fmt.Sprintf("idle%d", i), 1, now)
+	}
+	later := now.Add(time.Hour)
+	q.transferred("throttled", 100000000, later)
+	for i := 0; i < 2000; i++ {
+		q.transferred(fmt.Sprintf("active%d", i), 1, later)
+	}
+	if _, ok := q.bandwidths["idle0"]; ok || len(q.bandwidths) > 2001 {
+		t.Fatalf("Expected idle buckets to be dropped, got %d buckets", len(q.bandwidths))
+	}
+	if _, ok := q.bandwidths["throttled"]; !ok {
+		t.Fatal("Expected the bucket of a throttled user to be kept")
+	}
+	q.transferred("alice", 1000000, now)
+	_, err = q.acquire("alice", false, now)
+	var quotaErr *quotaExceededError
+	if !errors.As(err, &quotaErr) || quotaErr.retryAfter != 12*time.Hour {
+		t.Fatal("Expected the daily quota to be exceeded until midnight, got:", err)
+	}
+	if _, err = q.acquire("alice", false, now.Add(12*time.Hour)); err != nil {
+		t.Fatal("Expected the daily quota to reset the next day, got:", err)
+	}
+
+	r, _ := newAuthRequest("Basic " + string(EncodeAuthCredentials("alice", "pass")))
+	r.Host = "example.com:443"
+	q.transferred("alice", 1000000, time.Now())
+	err = h.ServeHTTP(httptest.NewRecorder(), r, nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected a user over quota to get 429, got:", err)
+	}
+}
+
+func TestUserQuotaStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quota.json")
+	provision := func() *UserQuota {
+		q := &UserQuota{MonthlyBytes: 1 << 30, StateFile: stateFile}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		if err := q.provision(ctx, ctx.Logger()); err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	now := time.Now()
+	q := provision()
+	q.transferred("alice", 1234, now)
+	reloaded := provision() // a config reload shares the counters with the running config
+	reloaded.transferred("alice", 1000, now)
+	for _, quota := range []*UserQuota{q, reloaded} {
+		if err := quota.cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := provision()
+	defer restarted.cleanup()
+	restarted.state.mu.Lock()
+	defer restarted.state.mu.Unlock()
+	if usage := restarted.usage("alice", now); usage.MonthBytes != 2234 || usage.DayBytes != 2234 {
+		t.Fatalf("Expected usage to be loaded from the state file, got: %+v", usage)
+	}
+}
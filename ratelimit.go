@@ -0,0 +1,178 @@
+package forwardproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// RateLimit admits new tunnels and forwarded requests at a limited rate, with a token bucket per key.
+type RateLimit struct {
+	// What requests are limited by: client_ip, target_host, or any placeholder expression
+	// (e.g. {http.auth.user.id} or {http.request.header.User-Agent}).
+	Key string `json:"key,omitempty"`
+
+	// Requests admitted per Window.
+	Rate int `json:"rate,omitempty"`
+
+	// Default: 1s.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Requests admitted at once after being idle. Default: Rate.
+	Burst int `json:"burst,omitempty"`
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep int
+}
+
+// rateLimitedError is returned for requests over a rate limit.
+type rateLimitedError struct {
+	key        string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return "rate limit exceeded for " + e.key
+}
+
+func (l *RateLimit) provision() error {
+	if len(l.Key) == 0 {
+		return errors.New("rate limit key is required")
+	}
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate limit of %s must be positive", l.Key)
+	}
+	if l.Window <= 0 {
+		l.Window = caddy.Duration(time.Second)
+	}
+	if l.Burst <= 0 {
+		l.Burst = l.Rate
+	}
+	l.buckets = make(map[string]*tokenBucket)
+	return nil
+}
+
+// key evaluates the key of the rate limit for r.
+func (l *RateLimit) key(r *http.Request) string {
+	switch l.Key {
+	case "client_ip":
+		return remoteIP(r)
+	case "target_host":
+		host, _, err := net.SplitHostPort(proxyRequestTarget(r))
+		if err != nil {
+			return proxyRequestTarget(r)
+		}
+		return host
+	}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return repl.ReplaceKnown(l.Key, "")
+}
+
+// allow admits a request with key, or returns how long to wait until it would be.
+func (l *RateLimit) allow(key string, now time.Time) (bool, time.Duration) {
+	return l.bucket(key, now).tryTake(1, now)
+}
+
+// bucket returns the bucket of key, creating it if needed.
+func (l *RateLimit) bucket(key string, now time.Time) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.buckets[key]
+	if bucket == nil {
+		if len(l.buckets) >= l.nextSweep {
+			for k, b := range l.buckets {
+				if b.full(now) {
+					delete(l.buckets, k)
+				}
+			}
+			l.nextSweep = 2*len(l.buckets) + 1024
+		}
+		bucket = newTokenBucket(float64(l.Rate)/time.Duration(l.Window).Seconds(), float64(l.Burst), now)
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// checkRateLimits admits r, or returns a *rateLimitedError for the first rate limit it exceeds.
+// Rejected requests do not count against any limit.
+func (h Handler) checkRateLimits(r *http.Request) error {
+	now := time.Now()
+	taken := make([]*tokenBucket, 0, len(h.RateLimits))
+	for _, limit := range h.RateLimits {
+		key := limit.key(r)
+		bucket := limit.bucket(key, now)
+		if ok, retryAfter := bucket.tryTake(1, now); !ok {
+			for _, b := range taken {
+				b.refund(1)
+			}
+			return &rateLimitedError{key: limit.Key + " " + key, retryAfter: retryAfter}
+		}
+		taken = append(taken, bucket)
+	}
+	return nil
+}
+
+// tokenBucket is a token bucket that can go into debt, which callers wait out.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take removes n tokens, and returns how long it takes until the bucket is out of debt again.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// tryTake removes n tokens if there are that many, or returns how long it takes until there will be.
+func (b *tokenBucket) tryTake(n float64, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// refund gives back n tokens that were taken.
+func (b *tokenBucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+n)
+}
+
+// full reports whether the bucket has been refilled completely, i.e. it is as if it had never been used.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
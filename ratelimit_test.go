@@ -0,0 +1,92 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRateLimits(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		rate_limit client_ip 2/1m
+		rate_limit target_host 1/1s 3
+		rate_limit {http.request.header.X-Tenant} 100
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(remoteAddr, target string) *http.Request {
+		r, _ := http.NewRequest(http.MethodConnect, "https://"+target, nil)
+		r.Host = target
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Tenant", "acme")
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.checkRateLimits(newRequest("192.0.2.1:1", "example.com:443")); err != nil {
+			t.Fatalf("Expected request %d to be admitted, got: %v", i, err)
+		}
+	}
+	err := h.checkRateLimits(newRequest("192.0.2.1:2", "example.org:443"))
+	var limited *rateLimitedError
+	if !errors.As(err, &limited) || limited.key != "client_ip 192.0.2.1" ||
+		limited.retryAfter <= 29*time.Second || limited.retryAfter > 30*time.Second {
+		t.Fatal("Expected the client IP to be limited for 30s, got:", err)
+	}
+	if err = h.checkRateLimits(newRequest("192.0.2.2:1", "example.com:443")); err != nil {
+		t.Fatal("Expected the burst of the target host to admit a third request, got:", err)
+	}
+	// rejected by the target host, which must not use up the client IP
+	if err = h.checkRateLimits(newRequest("192.0.2.4:1", "example.com:443")); !errors.As(err, &limited) ||
+		limited.key != "target_host example.com" {
+		t.Fatal("Expected the target host to be limited, got:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = h.checkRateLimits(newRequest("192.0.2.4:2", "example.org:443")); err != nil {
+			t.Fatal("Expected rejected requests not to count against earlier limits, got:", err)
+		}
+	}
+	if err = h.checkRateLimits(newRequest("192.0.2.4:3", "example.org:443")); !errors.As(err, &limited) ||
+		limited.key != "client_ip 192.0.2.4" {
+		t.Fatal("Expected the client IP to be limited after two admitted requests, got:", err)
+	}
+	if err = h.checkRateLimits(newRequest("192.0.2.3:1", "example.com:443")); !errors.As(err, &limited) ||
+		limited.key != "target_host example.com" {
+		t.Fatal("Expected the target host to be limited, got:", err)
+	}
+	if ok, _ := h.RateLimits[2].allow("acme", time.Now()); !ok {
+		t.Fatal("Expected the placeholder key to have room left")
+	}
+
+	w := httptest.NewRecorder()
+	err = h.ServeHTTP(w, newRequest("192.0.2.1:3", "example.net:443"), nil)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatal("Expected 429 with Retry-After, got:", err)
+	}
+
+	h.AuthCredentials = [][]byte{EncodeAuthCredentials("user", "pass")}
+	h.ProbeResistance = &ProbeResistance{}
+	r := newRequest("192.0.2.1:4", "example.net:443")
+	r.Header.Set("Proxy-Authorization", "Basic "+string(EncodeAuthCredentials("user", "pass")))
+	w = httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	if err = h.ServeHTTP(w, r, next); err != nil || w.Code != http.StatusTeapot {
+		t.Fatal("Expected a limited request to be passed through with probe resistance, got:", err, w.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package forwardproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+)
+
+// RouteRule chooses how to reach the destinations it matches: through one of UpstreamPools, or directly.
+// A rule matches if all of its conditions that are set do, and each condition matches if any of its values does.
+type RouteRule struct {
+	// Name of an upstream pool in UpstreamPools, or "direct".
+	Upstream string `json:"upstream"`
+
+	// Destinations, as in ACL subjects: domains (with *. for subdomains), IP addresses, CIDR ranges and categories.
+	// Since upstream proxies resolve hostnames on their own, IP rules (and GeoIP rules) only match destinations
+	// requested by IP address.
+	Destinations []string `json:"destinations,omitempty"`
+
+	// Destination ports.
+	Ports []int `json:"ports,omitempty"`
+
+	// Authenticated users.
+	Users []string `json:"users,omitempty"`
+
+	// IP addresses or CIDR ranges that the client asked to send from with Proxy-Nonlocal-Source.
+	Sources []string `json:"sources,omitempty"`
+
+	destinations []aclRule
+	sources      []*net.IPNet
+	upstreams    *upstreamPool // nil for direct
+}
+
+const routeDirect = "direct"
+
+func (r *RouteRule) provision(pools map[string]*upstreamPool, dbs aclDatabases) error {
+	if r.Upstream != routeDirect {
+		if r.upstreams = pools[r.Upstream]; r.upstreams == nil {
+			return fmt.Errorf("unknown upstream: %q", r.Upstream)
+		}
+	}
+	for _, subject := range r.Destinations {
+		rule, err := newACLRule(subject, "", true, dbs)
+		if err != nil {
+			return err
+		}
+		r.destinations = append(r.destinations, rule)
+	}
+	for _, port := range r.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port: %d", port)
+		}
+	}
+	for _, source := range r.Sources {
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return errors.New(source + ": expected an IP address or a CIDR range")
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		r.sources = append(r.sources, ipNet)
+	}
+	return nil
+}
+
+func (r *RouteRule) match(ctx context.Context, host, port string, bind net.Addr) bool {
+	if len(r.destinations) > 0 {
+		ip := net.ParseIP(host)
+		if !slices.ContainsFunc(r.destinations, func(rule aclRule) bool {
+			return rule.tryMatch(ip, host) == aclDecisionAllow
+		}) {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		if port, err := strconv.Atoi(port); err != nil || !slices.Contains(r.Ports, port) {
+			return false
+		}
+	}
+	if len(r.Users) > 0 {
+		if user, _ := ctx.Value(upstreamUserKey{}).(string); !slices.Contains(r.Users, user) {
+			return false
+		}
+	}
+	if len(r.sources) > 0 {
+		addr, ok := bind.(*net.TCPAddr)
+		if !ok || !slices.ContainsFunc(r.sources, func(ipNet *net.IPNet) bool { return ipNet.Contains(addr.IP) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the upstreams to dial host:port through, or nil to dial it directly,
+// by the first rule of Routes that matches, or Upstream and UpstreamPool if none does.
+func (h Handler) route(ctx context.Context, host, port string, bind net.Addr) *upstreamPool {
+	for i := range h.Routes {
+		if h.Routes[i].match(ctx, host, port, bind) {
+			return h.Routes[i].upstreams
+		}
+	}
+	return h.upstreams
+}
@@ -0,0 +1,164 @@
+package forwardproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRoutes(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		upstream http://127.0.0.1:1
+		upstream_pool a http://127.0.0.1:2
+		upstream_pool b http://127.0.0.1:3 http://127.0.0.1:4 {
+			policy target_hash
+		}
+		route direct {
+			to *.cn 203.0.113.0/24 127.0.0.0/8
+		}
+		route a {
+			to *.example.com
+			port 443
+		}
+		route b {
+			user alice
+			source 2001:db8::/32 192.0.2.1
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := h.Routes[1].upstreams, h.Routes[2].upstreams
+	if a == nil || b == nil || len(b.upstreams) != 2 || b.Policy != upstreamPolicyTargetHash {
+		t.Fatalf("Unexpected routes: %+v", h.Routes)
+	}
+	alice := context.WithValue(context.Background(), upstreamUserKey{}, "alice")
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}
+	for _, test := range []struct {
+		ctx       context.Context
+		host      string
+		port      string
+		bind      net.Addr
+		upstreams *upstreamPool
+	}{
+		{context.Background(), "www.example.cn", "443", nil, nil},
+		{alice, "example.cn", "443", source, nil},
+		{context.Background(), "203.0.113.7", "80", nil, nil},
+		{context.Background(), "www.example.com", "443", nil, a},
+		{context.Background(), "www.example.com", "80", nil, h.upstreams},
+		{context.Background(), "example.com", "443", nil, a},
+		{context.Background(), "example.net", "443", nil, h.upstreams},
+		{alice, "example.org", "443", source, b},
+		{alice, "example.org", "443", &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, b},
+		{alice, "example.org", "443", nil, h.upstreams},
+		{context.Background(), "example.org", "443", source, h.upstreams},
+	} {
+		if upstreams := h.route(test.ctx, test.host, test.port, test.bind); upstreams != test.upstreams {
+			t.Errorf("Unexpected route for %s:%s from %v", test.host, test.port, test.bind)
+		}
+	}
+
+	// the chosen pool is dialed, and the others are not
+	var dialedA, dialedDefault []int
+	fakeUpstreams(a, &dialedA, nil)
+	fakeUpstreams(h.upstreams, &dialedDefault, nil)
+	conn, upstreams, err := h.dialContextRoute(context.Background(), "tcp", "www.example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dialedA) != 1 || len(dialedDefault) != 0 || upstreams != a {
+		t.Fatalf("Expected to dial through upstream a, got: %v, %v", dialedA, dialedDefault)
+	}
+	// hosts found in the tunnel are checked as destinations of its route, whatever their own route is
+	if err = h.checkTunnelHost(context.Background(), "www.example.cn", conn, upstreams); err != nil {
+		t.Fatal("Expected the host to be allowed through upstream a, got:", err)
+	}
+	if err = h.checkTunnelHost(context.Background(), "127.0.0.1", conn, upstreams); err == nil {
+		t.Fatal("Expected the ACL to apply to hosts in the tunnel")
+	}
+	_ = conn.Close()
+	if _, err = h.dialContextCheckACL(context.Background(), "tcp", "127.0.0.1:80", nil); err == nil {
+		t.Fatal("Expected the ACL to apply to direct routes")
+	}
+}
+
+func TestRoutesInvalid(t *testing.T) {
+	for _, config := range []string{
+		`route nowhere {
+			to example.com
+		}`,
+		`upstream_pool direct http://127.0.0.1:1`,
+		`route direct {
+			source example.com
+		}`,
+		`route direct {
+			to category:ads
+		}`,
+	} {
+		var h Handler
+		if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward_proxy {\n" + config + "\n}")); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Provision(caddy.Context{Context: context.Background()}); err == nil {
+			t.Errorf("Expected an error for %s", config)
+		}
+	}
+}
+
+// TestRoutesPlainHTTP checks that plain HTTP requests on direct routes are sent directly, with the transport,
+// while the others go through the upstream.
+func TestRoutesPlainHTTP(t *testing.T) {
+	var h Handler
+	d := caddyfile.NewTestDispenser(`forward_proxy {
+		upstream http://127.0.0.1:1
+		route direct {
+			to 203.0.113.0/24
+		}
+	}`)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Provision(caddy.Context{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *http.Request, 2)
+	var dialedDirect []string
+	h.dialContext = func(ctx context.Context, network, address string, bind net.Addr) (net.Conn, error) {
+		dialedDirect = append(dialedDirect, address)
+		return fakeHTTPServer(received), nil
+	}
+	var dialedUpstream []string
+	h.upstreams.upstreams[0].dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialedUpstream = append(dialedUpstream, address)
+		return fakeHTTPServer(received), nil
+	}
+	for _, target := range []string{"http://203.0.113.7/", "http://example.com/"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, r, nil); err != nil || w.Code != http.StatusNoContent {
+			t.Fatalf("Expected %s to be relayed, got: %v, %d", target, err, w.Code)
+		}
+		// the transport does not keep connections alive, and says so
+		if req := <-received; req == nil || req.Close != (target == "http://203.0.113.7/") {
+			t.Fatalf("Expected only %s to be sent by the transport", target)
+		}
+	}
+	if len(dialedDirect) != 1 || dialedDirect[0] != "203.0.113.7:80" ||
+		len(dialedUpstream) != 1 || dialedUpstream[0] != "example.com:80" {
+		t.Fatalf("Unexpected dials: direct %v, upstream %v", dialedDirect, dialedUpstream)
+	}
+	if conns := h.upstreams.upstreams[0].conns.Load(); conns != 0 {
+		t.Fatal("Expected the upstream connection to be closed, got open connections:", conns)
+	}
+}
@@ -0,0 +1,60 @@
+package forwardproxy
+
+import "strings"
+
+// domainTrie maps domains to values, matching a domain along with all of its subdomains.
+// Labels are stored from the TLD down, so a lookup walks the trie once per label of the queried domain.
+type domainTrie struct {
+	children map[string]*domainTrie
+	values   []string
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+// insert associates value with domain and all of its subdomains.
+func (t *domainTrie) insert(domain, value string) {
+	node := t
+	labels := strings.Split(normalizeDomain(domain), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*domainTrie)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	for _, v := range node.values {
+		if v == value {
+			return
+		}
+	}
+	node.values = append(node.values, value)
+}
+
+// contains reports whether value is associated with domain or one of its parent domains.
+func (t *domainTrie) contains(domain, value string) bool {
+	node := t
+	labels := strings.Split(normalizeDomain(domain), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node = node.children[labels[i]]; node == nil {
+			return false
+		}
+		for _, v := range node.values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeDomain lowercases domain and strips wildcard prefix and dots around it.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimPrefix(domain, "*.")
+	return strings.ToLower(strings.Trim(domain, "."))
+}
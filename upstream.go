@@ -0,0 +1,323 @@
+package forwardproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	mathrand "math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mygod/nonlocalforwardproxy/httpclient"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamPool is a pool of upstream proxies, with load balancing and failover.
+type UpstreamPool struct {
+	// URLs of the upstream proxies, as in Upstream.
+	URLs []string `json:"urls,omitempty"`
+
+	// How an upstream is chosen for each dial: round_robin (default), random, least_conn (fewest open connections),
+	// target_hash (by the host dialed) or user_hash (by the authenticated user).
+	// Only available upstreams are chosen from, unless none is.
+	Policy string `json:"policy,omitempty"`
+
+	// If set, every HealthCheckInterval, each upstream is asked to CONNECT to this host:port, and it is
+	// unavailable until that succeeds again.
+	HealthCheckTarget string `json:"health_check_target,omitempty"`
+
+	// Default: 30s.
+	HealthCheckInterval caddy.Duration `json:"health_check_interval,omitempty"`
+
+	// Default: 5s.
+	HealthCheckTimeout caddy.Duration `json:"health_check_timeout,omitempty"`
+
+	// After MaxFails failed dials within FailDuration, an upstream is unavailable for FailDuration.
+	// Upstreams that answer but refuse to connect to the target are not failing. Default: 1.
+	MaxFails int `json:"max_fails,omitempty"`
+
+	// Default: 30s.
+	FailDuration caddy.Duration `json:"fail_duration,omitempty"`
+
+	// How many other upstreams to try when dialing through one fails. Default: all of them.
+	Retries *int `json:"retries,omitempty"`
+}
+
+const (
+	upstreamPolicyRoundRobin = "round_robin"
+	upstreamPolicyRandom     = "random"
+	upstreamPolicyLeastConn  = "least_conn"
+	upstreamPolicyTargetHash = "target_hash"
+	upstreamPolicyUserHash   = "user_hash"
+)
+
+// upstreamUserKey is the key of the authenticated user in the context of dials, for user_hash and routes.
+type upstreamUserKey struct{}
+
+// upstreamPool dials through one of its upstreams.
+type upstreamPool struct {
+	*UpstreamPool
+	upstreams []*upstream
+	next      atomic.Uint64 // for round_robin
+}
+
+type upstream struct {
+	url   *url.URL
+	dial  func(ctx context.Context, network, address string) (net.Conn, error)
+	conns atomic.Int64
+
+	mu          sync.Mutex
+	unhealthy   bool // by health checks
+	fails       int
+	firstFail   time.Time
+	ejectedTill time.Time
+}
+
+func newUpstreamPool(ctx caddy.Context, config *UpstreamPool, dialer *net.Dialer, logger *zap.Logger) (*upstreamPool, error) {
+	if len(config.URLs) == 0 {
+		return nil, errors.New("no upstream URLs")
+	}
+	switch config.Policy {
+	case "":
+		config.Policy = upstreamPolicyRoundRobin
+	case upstreamPolicyRoundRobin, upstreamPolicyRandom, upstreamPolicyLeastConn, upstreamPolicyTargetHash,
+		upstreamPolicyUserHash:
+	default:
+		return nil, fmt.Errorf("unknown policy: %s", config.Policy)
+	}
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = caddy.Duration(30 * time.Second)
+	}
+	if config.HealthCheckTimeout == 0 {
+		config.HealthCheckTimeout = caddy.Duration(5 * time.Second)
+	}
+	if config.MaxFails == 0 {
+		config.MaxFails = 1
+	}
+	if config.FailDuration == 0 {
+		config.FailDuration = caddy.Duration(30 * time.Second)
+	}
+	if config.HealthCheckInterval < 0 || config.HealthCheckTimeout < 0 || config.MaxFails < 0 || config.FailDuration < 0 ||
+		config.Retries != nil && *config.Retries < 0 {
+		return nil, errors.New("limits cannot be negative")
+	}
+	if len(config.HealthCheckTarget) > 0 {
+		if _, _, err := net.SplitHostPort(config.HealthCheckTarget); err != nil {
+			return nil, fmt.Errorf("bad health_check_target: %v", err)
+		}
+	}
+
+	p := &upstreamPool{UpstreamPool: config}
+	for _, rawURL := range config.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream URL: %v", err)
+		}
+		if !isLocalhost(u.Hostname()) && u.Scheme != "https" {
+			return nil, errors.New("insecure schemes are only allowed to localhost upstreams")
+		}
+		dial, err := newUpstreamDialer(u, dialer, logger)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, &upstream{url: u, dial: dial})
+	}
+	if len(config.HealthCheckTarget) > 0 {
+		go p.checkHealth(ctx, logger)
+	}
+	return p, nil
+}
+
+// newUpstreamDialer returns a function that dials through the upstream proxy at u.
+// HTTP(S) upstreams are dialed directly, rather than registered in the global registry of x/net/proxy.
+func newUpstreamDialer(u *url.URL, dialer *net.Dialer, logger *zap.Logger) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	if u.Scheme == "http" || u.Scheme == "https" {
+		// CONNECT request is proxied as-is, so we don't care about target url.
+		d, err := httpclient.NewHTTPConnectDialer(u.String())
+		if err != nil {
+			return nil, errors.New("failed to create proxy to upstream: " + err.Error())
+		}
+		d.Dialer = *dialer
+		if isLocalhost(u.Hostname()) && u.Scheme == "https" {
+			// disabling verification helps with testing the package and setups
+			// either way, it's impossible to have a legit TLS certificate for "127.0.0.1" - TODO: not true anymore
+			logger.Info("Localhost upstream detected, disabling verification of TLS certificate")
+			d.DialTLS = func(network string, address string) (net.Conn, string, error) {
+				conn, err := tls.Dial(network, address, &tls.Config{InsecureSkipVerify: true}) // #nosec G402
+				if err != nil {
+					return nil, "", err
+				}
+				return conn, conn.ConnectionState().NegotiatedProtocol, nil
+			}
+		}
+		return d.DialContext, nil
+	}
+
+	upstreamDialer, err := proxy.FromURL(u, dialer)
+	if err != nil {
+		return nil, errors.New("failed to create proxy to upstream: " + err.Error())
+	}
+	if ctxDialer, ok := upstreamDialer.(dialContexter); ok {
+		// upstreamDialer has DialContext - use it
+		return ctxDialer.DialContext, nil
+	}
+	// upstreamDialer does not have DialContext - ignore the context :(
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return upstreamDialer.Dial(network, address)
+	}, nil
+}
+
+// available reports whether the upstream passes health checks and is not ejected for failing.
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.unhealthy && !now.Before(u.ejectedTill)
+}
+
+func (u *upstream) failed(maxFails int, failDuration time.Duration, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.fails == 0 || now.Sub(u.firstFail) > failDuration {
+		u.fails, u.firstFail = 0, now
+	}
+	if u.fails++; u.fails >= maxFails {
+		u.fails = 0
+		u.ejectedTill = now.Add(failDuration)
+	}
+}
+
+func (u *upstream) succeeded() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails = 0
+}
+
+// candidates returns the upstreams to try to dial address through, in order.
+func (p *upstreamPool) candidates(ctx context.Context, address string, now time.Time) []*upstream {
+	var candidates []*upstream
+	for _, u := range p.upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 { // trying is better than failing right away
+		candidates = append(candidates, p.upstreams...)
+	}
+	first := 0
+	switch p.Policy {
+	case upstreamPolicyRoundRobin:
+		first = int((p.next.Add(1) - 1) % uint64(len(candidates)))
+	case upstreamPolicyRandom:
+		first = mathrand.Intn(len(candidates))
+	case upstreamPolicyLeastConn:
+		for i, u := range candidates {
+			if u.conns.Load() < candidates[first].conns.Load() {
+				first = i
+			}
+		}
+	case upstreamPolicyTargetHash:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		first = upstreamHash(host, len(candidates))
+	case upstreamPolicyUserHash:
+		user, _ := ctx.Value(upstreamUserKey{}).(string)
+		first = upstreamHash(user, len(candidates))
+	}
+	return append(candidates[first:], candidates[:first]...)
+}
+
+func upstreamHash(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// dialContext dials address through an upstream, trying others if that fails.
+func (p *upstreamPool) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	candidates := p.candidates(ctx, address, time.Now())
+	if p.Retries != nil && *p.Retries+1 < len(candidates) {
+		candidates = candidates[:*p.Retries+1]
+	}
+	var err error
+	for _, u := range candidates {
+		var conn net.Conn
+		if conn, err = u.dial(ctx, network, address); err == nil {
+			u.succeeded()
+			u.conns.Add(1)
+			return &upstreamConn{Conn: conn, upstream: u}, nil
+		}
+		var statusErr *httpclient.StatusError
+		if !errors.As(err, &statusErr) && ctx.Err() == nil {
+			u.failed(p.MaxFails, time.Duration(p.FailDuration), time.Now())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// checkHealth dials HealthCheckTarget through every upstream, every HealthCheckInterval, until ctx is done.
+func (p *upstreamPool) checkHealth(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(time.Duration(p.HealthCheckInterval))
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				checkCtx, cancel := context.WithTimeout(ctx, time.Duration(p.HealthCheckTimeout))
+				defer cancel()
+				conn, err := u.dial(checkCtx, "tcp", p.HealthCheckTarget)
+				if err == nil {
+					_ = conn.Close()
+				}
+				u.mu.Lock()
+				changed := u.unhealthy != (err != nil)
+				u.unhealthy = err != nil
+				u.mu.Unlock()
+				if changed && err != nil {
+					logger.Warn("upstream failed health check", zap.String("upstream", u.url.Redacted()), zap.Error(err))
+				} else if changed {
+					logger.Info("upstream passed health check", zap.String("upstream", u.url.Redacted()))
+				}
+			}(u)
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// upstreamConn counts the open connections of an upstream, for least_conn.
+type upstreamConn struct {
+	net.Conn
+	upstream *upstream
+	once     sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() { c.upstream.conns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-closing the tunnel working.
+func (c *upstreamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}